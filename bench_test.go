@@ -0,0 +1,80 @@
+package subly
+
+import "testing"
+
+// wideService has many handler methods, to measure per method costs.
+type wideService struct{}
+
+func (*wideService) Action01Message(p *person)      {}
+func (*wideService) Action02Message(p *person)      {}
+func (*wideService) Action03Message(p *person)      {}
+func (*wideService) Action04Message(p *person)      {}
+func (*wideService) Action05MessageQueue(p *person) {}
+func (*wideService) Action06Message(p *person)      {}
+func (*wideService) Action07Message(p *person)      {}
+func (*wideService) Action08Message(p *person)      {}
+func (*wideService) Action09Message(p *person)      {}
+func (*wideService) Action10MessageQueue(p *person) {}
+func (*wideService) Action11Message(p *person)      {}
+func (*wideService) Action12Message(p *person)      {}
+func (*wideService) Action13Message(p *person)      {}
+func (*wideService) Action14Message(p *person)      {}
+func (*wideService) Action15MessageQueue(p *person) {}
+func (*wideService) Action16Message(p *person)      {}
+func (*wideService) Action17Message(p *person)      {}
+func (*wideService) Action18Message(p *person)      {}
+func (*wideService) Action19Message(p *person)      {}
+func (*wideService) Action20MessageQueue(p *person) {}
+func (*wideService) Action21Message(p *person)      {}
+func (*wideService) Action22Message(p *person)      {}
+func (*wideService) Action23Message(p *person)      {}
+func (*wideService) Action24Message(p *person)      {}
+func (*wideService) Action25MessageQueue(p *person) {}
+func (*wideService) Action26Message(p *person)      {}
+func (*wideService) Action27Message(p *person)      {}
+func (*wideService) Action28Message(p *person)      {}
+func (*wideService) Action29Message(p *person)      {}
+func (*wideService) Action30MessageQueue(p *person) {}
+func (*wideService) Action31Message(p *person)      {}
+func (*wideService) Action32Message(p *person)      {}
+func (*wideService) Action33Message(p *person)      {}
+func (*wideService) Action34Message(p *person)      {}
+func (*wideService) Action35MessageQueue(p *person) {}
+func (*wideService) Action36Message(p *person)      {}
+func (*wideService) Action37Message(p *person)      {}
+func (*wideService) Action38Message(p *person)      {}
+func (*wideService) Action39Message(p *person)      {}
+func (*wideService) Action40MessageQueue(p *person) {}
+func (*wideService) Action41Message(p *person)      {}
+func (*wideService) Action42Message(p *person)      {}
+func (*wideService) Action43Message(p *person)      {}
+func (*wideService) Action44Message(p *person)      {}
+func (*wideService) Action45MessageQueue(p *person) {}
+func (*wideService) Action46Message(p *person)      {}
+func (*wideService) Action47Message(p *person)      {}
+func (*wideService) Action48Message(p *person)      {}
+func (*wideService) Action49Message(p *person)      {}
+func (*wideService) Action50MessageQueue(p *person) {}
+
+func BenchmarkGetMessagesWide(b *testing.B) {
+	o := newOptions()
+	for i := 0; i < b.N; i++ {
+		getMessages(&wideService{}, o)
+	}
+}
+
+func BenchmarkPlanWide(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		o := newOptions(WithSubjectPrefix("tenant"))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			o.plan(&wideService{})
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			newOptions(WithSubjectPrefix("tenant")).plan(&wideService{})
+		}
+	})
+}
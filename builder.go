@@ -0,0 +1,127 @@
+package subly
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// TypedHandler is a handler bound without reflection, made by Typed.
+type TypedHandler interface {
+	bind(s *Subscriber, subject string) func(*nats.Msg)
+}
+
+type typedHandler[T any] func(*T)
+
+func (h typedHandler[T]) bind(s *Subscriber, subject string) func(*nats.Msg) {
+	return typed(s, subject, (func(*T))(h))
+}
+
+// Typed wraps a strongly typed handler, to be registered on a Builder without
+// reflection based dispatch, like SubscribeTyped.
+func Typed[T any](handler func(*T)) TypedHandler {
+	return typedHandler[T](handler)
+}
+
+// Builder registers handlers under explicit service and message names, as the explicit
+// counterpart of Subscribe. Subjects and queue names get built from the names by
+// the same rules, using the subject prefix and separators of the Subscriber, and
+// the subscriptions get unsubscribed when context got canceled.
+//
+// Handlers made with Typed are bound without reflection. Other supported
+// signatures are accepted too, and get dispatched like in SubscribeFunc.
+type Builder struct {
+	s       *Subscriber
+	service string
+	queue   string
+	entries []builderEntry
+	errs    []error
+}
+
+type builderEntry struct {
+	name, subject, queue string
+	handler              interface{}
+}
+
+// Handler returns a Builder for registering handlers on s.
+func (s *Subscriber) Handler() *Builder {
+	return &Builder{s: s}
+}
+
+// Service sets the service name of the following handlers, and resets the queue group.
+func (b *Builder) Service(name string) *Builder {
+	b.service = name
+	b.queue = ""
+	return b
+}
+
+// Queue sets the queue group of the following MessageQueue handlers, instead of
+// the one derived from the service and message names.
+func (b *Builder) Queue(name string) *Builder {
+	b.queue = name
+	return b
+}
+
+// Message registers handler, as a plain subscriber, for the message name of the current service.
+func (b *Builder) Message(name string, handler interface{}) *Builder {
+	return b.add(name, handler, false)
+}
+
+// MessageQueue registers handler, as a member of a queue group, for the message name
+// of the current service.
+func (b *Builder) MessageQueue(name string, handler interface{}) *Builder {
+	return b.add(name, handler, true)
+}
+
+func (b *Builder) add(name string, handler interface{}, queue bool) *Builder {
+	if b.service == "" || name == "" {
+		b.errs = append(b.errs, fmt.Errorf("subly: handler %q of service %q: empty name", name, b.service))
+		return b
+	}
+	v := serviceMessage{serviceName: b.service, messageName: name, queueName: b.queue}
+	e := builderEntry{name: b.service + b.s.opts.separator + name, subject: b.s.opts.subject(v), handler: handler}
+	if queue {
+		e.queue = b.s.opts.queueName(v)
+	}
+	b.entries = append(b.entries, e)
+	return b
+}
+
+// Subscribe subscribes the registered handlers, and returns the failures.
+func (b *Builder) Subscribe() error {
+	errs := append([]error(nil), b.errs...)
+	for _, e := range b.entries {
+		if err := b.s.noteBind(e.subject, b.bind(e)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return b.s.flushAfter(errors.Join(errs...))
+}
+
+func (b *Builder) bind(e builderEntry) error {
+	s := b.s
+	h, ok := e.handler.(TypedHandler)
+	if !ok {
+		_, err := s.bindEntry(e.subject, FuncEntry{Subject: e.name, Handler: e.handler, Queue: e.queue})
+		return err
+	}
+	if err := s.validate(e.subject, e.name); err != nil {
+		return err
+	}
+	if err := s.claim(e.subject, e.name); err != nil {
+		return subscribeError(e.subject, err)
+	}
+	cb := h.bind(s, e.subject)
+	_, err := s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		if e.queue != "" {
+			return s.conn.QueueSubscribe(e.subject, e.queue, cb)
+		}
+		return s.conn.Subscribe(e.subject, cb)
+	}))
+	if err != nil {
+		s.release(e.subject)
+		return subscribeError(e.subject, err)
+	}
+	return nil
+}
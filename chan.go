@@ -0,0 +1,66 @@
+package subly
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrUnsupportedConn is returned when the connection provided to NewSubscriber
+// does not support an operation.
+var ErrUnsupportedConn = errors.New("subly: operation not supported by connection")
+
+// chanConn is the part of *nats.Conn used for delivering messages on channels.
+type chanConn interface {
+	ChanSubscribe(subject string, ch chan *nats.Msg) (*nats.Subscription, error)
+	ChanQueueSubscribe(subject, queue string, ch chan *nats.Msg) (*nats.Subscription, error)
+}
+
+func (s *Subscriber) chanConn() (chanConn, error) {
+	switch c := s.conn.(type) {
+	case *nats.EncodedConn:
+		return c.Conn, nil
+	case chanConn:
+		return c, nil
+	}
+	return nil, ErrUnsupportedConn
+}
+
+// SubscribeChan subscribes to subject, delivering messages on ch, for consuming
+// them in a custom worker loop. Like SubscribeFunc, the subject prefix applies and
+// the subscription gets unsubscribed when context got canceled. The pending limits do
+// not apply, as the capacity of ch bounds the pending messages.
+func (s *Subscriber) SubscribeChan(subject string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return s.subscribeChan(subject, "", ch)
+}
+
+// QueueSubscribeChan is the queue variant of SubscribeChan.
+func (s *Subscriber) QueueSubscribeChan(subject, queue string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return s.subscribeChan(subject, queue, ch)
+}
+
+func (s *Subscriber) subscribeChan(subject, queue string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	subject = s.opts.prefixed(subject)
+	if err := s.validate(subject, subject); err != nil {
+		return nil, s.noteBind(subject, err)
+	}
+	cc, err := s.chanConn()
+	if err != nil {
+		return nil, s.noteBind(subject, subscribeError(subject, err))
+	}
+	if err := s.claim(subject, subject); err != nil {
+		return nil, s.noteBind(subject, subscribeError(subject, err))
+	}
+	sub, err := s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		if queue != "" {
+			return cc.ChanQueueSubscribe(subject, queue, ch)
+		}
+		return cc.ChanSubscribe(subject, ch)
+	}))
+	if err != nil {
+		s.release(subject)
+		return nil, s.noteBind(subject, subscribeError(subject, err))
+	}
+	s.noteBind(subject, nil)
+	return sub, s.flushAfter(nil)
+}
@@ -0,0 +1,655 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn records subscriptions, instead of talking to a NATS server.
+type fakeConn struct {
+	mu        sync.Mutex
+	subjects  []string
+	handlers  map[string]nats.Handler
+	published map[string][]interface{}
+	err       error
+}
+
+func (fc *fakeConn) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	return fc.QueueSubscribe(subject, "", cb)
+}
+
+func (fc *fakeConn) QueueSubscribe(subject, queue string, cb nats.Handler) (*nats.Subscription, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.err != nil {
+		return nil, fc.err
+	}
+	key := subject
+	if queue != "" {
+		key = subject + "@" + queue
+	}
+	fc.subjects = append(fc.subjects, key)
+	sort.Strings(fc.subjects)
+	if fc.handlers == nil {
+		fc.handlers = make(map[string]nats.Handler)
+	}
+	fc.handlers[subject] = cb
+	return &nats.Subscription{Subject: subject, Queue: queue}, nil
+}
+
+func (fc *fakeConn) Publish(subject string, v interface{}) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.published == nil {
+		fc.published = make(map[string][]interface{})
+	}
+	fc.published[subject] = append(fc.published[subject], v)
+	return nil
+}
+
+func TestSubscribeFakeConn(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithSubjectPrefix("tenanta"))
+	assert.NoError(t, s.Subscribe(&someService{}))
+	subs, err := s.SubscribeFunc(map[string]interface{}{
+		"other.action": func(p *person) {},
+	}, "other")
+	assert.NoError(t, err)
+	assert.Equal(t, "tenanta.other.action", subs["other.action"].Subject)
+	assert.Equal(t, []string{
+		"tenanta.other.action@other",
+		"tenanta.someservice.action1",
+		"tenanta.someservice.action2@someservice_action2",
+	}, fc.subjects)
+	assert.Len(t, s.Subscriptions(), 3)
+	if sub, ok := s.SubscriptionFor("tenanta.someservice.action2"); assert.True(t, ok) {
+		assert.Equal(t, "someservice_action2", sub.Queue)
+	}
+	_, ok := s.SubscriptionFor("someservice.action2")
+	assert.False(t, ok)
+	assert.NoError(t, s.Close())
+}
+
+func TestSubscribeFakeConnReply(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	_, err := s.SubscribeFunc(map[string]interface{}{
+		"someservice.echo": func(p *person) *person { return p },
+	})
+	assert.NoError(t, err)
+	h, ok := fc.handlers["someservice.echo"].(func(*nats.Msg))
+	if !assert.True(t, ok) {
+		return
+	}
+	h(msg("someservice.echo", "_INBOX.1", &person{Name: "dc0d"}))
+	assert.Equal(t, []interface{}{&person{Name: "dc0d"}}, fc.published["_INBOX.1"])
+}
+
+func TestSubscribeFuncQueue(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	handler := func(p *person) {}
+	assert.NoError(t, s.SubscribeFuncQueue([]FuncEntry{
+		{Subject: "orders.created", Handler: handler},
+		{Subject: "orders.process", Handler: handler, Queue: "workers"},
+		{Subject: "orders.audit", Handler: handler, Queue: "auditors"},
+	}))
+	assert.Equal(t, []string{
+		"orders.audit@auditors",
+		"orders.created",
+		"orders.process@workers",
+	}, fc.subjects)
+}
+
+func TestSubscribeFuncPartialFailure(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithStrictSignatures())
+	subs, err := s.SubscribeFunc(map[string]interface{}{
+		"orders.created": func(p *person) {},
+		"orders.typo":    func(p *person, subject string) {},
+	})
+	assert.ErrorIs(t, err, ErrUnsupportedSignature)
+	assert.Contains(t, err.Error(), "orders.typo")
+	assert.Len(t, subs, 1)
+	assert.NotNil(t, subs["orders.created"])
+}
+
+type flushConn struct {
+	fakeConn
+	flushed int
+}
+
+func (fc *flushConn) Flush() error {
+	fc.flushed++
+	return nil
+}
+
+func TestSubscribeFlushAfterSubscribe(t *testing.T) {
+	fc := &flushConn{}
+	s := NewSubscriber(ctx, fc, WithFlushAfterSubscribe())
+	assert.NoError(t, s.Subscribe(&someService{}))
+	assert.Equal(t, 1, fc.flushed)
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fc.flushed)
+
+	assert.NoError(t, SubscribeTyped(s, "typed", func(p *person) {}))
+	assert.NoError(t, QueueSubscribeTyped(s, "typedq", "workers", func(p *person) {}))
+	assert.Equal(t, 4, fc.flushed)
+
+	cc := &chanFlushConn{}
+	s = NewSubscriber(ctx, cc, WithFlushAfterSubscribe())
+	_, err = s.SubscribeChan("chan", make(chan *nats.Msg))
+	assert.NoError(t, err)
+	_, err = s.QueueSubscribeChan("chanq", "workers", make(chan *nats.Msg))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cc.flushed)
+
+	s = NewSubscriber(ctx, &fakeConn{}, WithFlushAfterSubscribe())
+	assert.ErrorIs(t, s.Subscribe(&someService{}), ErrUnsupportedConn)
+}
+
+type chanFlushConn struct{ flushConn }
+
+func (cc *chanFlushConn) ChanSubscribe(subject string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return cc.ChanQueueSubscribe(subject, "", ch)
+}
+
+func (cc *chanFlushConn) ChanQueueSubscribe(subject, queue string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return &nats.Subscription{Subject: subject, Queue: queue}, nil
+}
+
+func TestResubscribe(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.NoError(t, err)
+	before := s.Subscriptions()
+
+	// subscriptions of fakeConn are never valid, so all get recreated
+	s.resubscribe()
+	assert.Equal(t, []string{"other.action", "other.action"}, fc.subjects)
+	after := s.Subscriptions()
+	assert.Len(t, after, 1)
+	assert.NotSame(t, before[0], after[0])
+}
+
+// blockConn blocks subscribing, once armed, until released.
+type blockConn struct {
+	fakeConn
+	armed   bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bc *blockConn) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	if bc.armed {
+		bc.entered <- struct{}{}
+		<-bc.release
+	}
+	return bc.fakeConn.Subscribe(subject, cb)
+}
+
+func TestResubscribeUnlocked(t *testing.T) {
+	bc := &blockConn{entered: make(chan struct{}), release: make(chan struct{})}
+	s := NewSubscriber(ctx, bc)
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.NoError(t, err)
+	before := s.Subscriptions()
+
+	bc.armed = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.resubscribe()
+	}()
+	<-bc.entered
+	listed := make(chan []*nats.Subscription)
+	go func() { listed <- s.Subscriptions() }()
+	select {
+	case subs := <-listed:
+		assert.Equal(t, before, subs)
+	case <-time.After(time.Second):
+		t.Fatal("resubscribe holds the lock while subscribing")
+	}
+	close(bc.release)
+	<-done
+	after := s.Subscriptions()
+	assert.Len(t, after, 1)
+	assert.NotSame(t, before[0], after[0])
+}
+
+type dupService struct{}
+
+func (dupService) ItemMessage(p *person) {}
+func (dupService) ITEMMessage(p *person) {}
+
+func TestSubscribeNoDuplicates(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithNoDuplicates())
+	err := s.Subscribe(dupService{})
+	assert.ErrorIs(t, err, ErrDuplicateSubject)
+	assert.Contains(t, err.Error(), "subly.dupService.ITEMMessage and subly.dupService.ItemMessage")
+	assert.Equal(t, []string{"dupservice.item"}, fc.subjects)
+
+	_, err = s.SubscribeFunc(map[string]interface{}{"dupservice.item": func(p *person) {}})
+	assert.ErrorIs(t, err, ErrDuplicateSubject)
+
+	fc = &fakeConn{}
+	s = NewSubscriber(ctx, fc)
+	assert.NoError(t, s.Subscribe(dupService{}))
+	assert.Len(t, fc.subjects, 2)
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	assert.NoError(t, s.SubscribeFiltered(&someService{}, func(methodName string) bool {
+		return strings.HasSuffix(methodName, "MessageQueue")
+	}))
+	assert.Equal(t, []string{"someservice.action2@someservice_action2"}, fc.subjects)
+}
+
+func TestSubscribeAll(t *testing.T) {
+	fc := &flushConn{}
+	s := NewSubscriber(ctx, fc, WithStrictSignatures(), WithFlushAfterSubscribe())
+	err := s.SubscribeAll(&someService{}, &typoService{}, &eventService{})
+	assert.ErrorIs(t, err, ErrUnsupportedSignature)
+	assert.Contains(t, err.Error(), "*subly.typoService.ActionMessage")
+	assert.Equal(t, []string{
+		"eventservice.delete",
+		"someservice.action1",
+		"someservice.action2@someservice_action2",
+	}, fc.subjects)
+	assert.Equal(t, 1, fc.flushed)
+
+	fc.err = errors.New("refused")
+	err = s.SubscribeAll(&eventService{})
+	assert.Contains(t, err.Error(), `subscribe "eventservice.delete" of *subly.eventService.DeleteMessage: refused`)
+}
+
+func TestEvents(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.NoError(t, err)
+	s.resubscribe()
+	assert.Equal(t, Event{Type: EventSubscribed, Subject: "other.action"}, <-s.Events())
+	assert.Equal(t, Event{Type: EventResubscribed, Subject: "other.action"}, <-s.Events())
+	assert.Equal(t, "resubscribed", EventResubscribed.String())
+
+	for i := 0; i < eventBuffer+3; i++ {
+		_, err := s.SubscribeN(fmt.Sprintf("other.action%d", i), 0, func(p *person) {})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, s.Events(), eventBuffer)
+	assert.Equal(t, uint64(3), s.DroppedEvents())
+}
+
+type badSubjectService struct{ someService }
+
+func (*badSubjectService) SubjectFor(method string) (string, bool) {
+	return "legacy action", method == "Action1Message"
+}
+
+func TestSubscribeSubjectValidation(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithSubjectValidation())
+	err := s.Subscribe(&badSubjectService{})
+	assert.ErrorIs(t, err, ErrInvalidSubject)
+	assert.Contains(t, err.Error(), `*subly.badSubjectService.Action1Message has "legacy action"`)
+	assert.Equal(t, []string{"badsubjectservice.action2@badsubjectservice_action2"}, fc.subjects)
+
+	for _, subject := range []string{"", ".lead", "trail.", "empty..token", "null\x00"} {
+		_, err := s.SubscribeFunc(map[string]interface{}{subject: func(p *person) {}})
+		assert.ErrorIs(t, err, ErrInvalidSubject, subject)
+		assert.ErrorIs(t, SubscribeTyped(s, subject, func(p *person) {}), ErrInvalidSubject, subject)
+		assert.ErrorIs(t, QueueSubscribeTyped(s, subject, "workers", func(p *person) {}), ErrInvalidSubject, subject)
+		_, err = s.SubscribeChan(subject, make(chan *nats.Msg))
+		assert.ErrorIs(t, err, ErrInvalidSubject, subject)
+		_, err = s.QueueSubscribeChan(subject, "workers", make(chan *nats.Msg))
+		assert.ErrorIs(t, err, ErrInvalidSubject, subject)
+	}
+	_, err = s.SubscribeFunc(map[string]interface{}{"orders.*.created": func(p *person) {}, "orders.>": func(p *person) {}})
+	assert.NoError(t, err)
+}
+
+type orderConn struct {
+	fakeConn
+	order []string
+}
+
+func (oc *orderConn) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	oc.order = append(oc.order, subject)
+	return oc.fakeConn.Subscribe(subject, cb)
+}
+
+func TestSubscribeFuncOrder(t *testing.T) {
+	oc := &orderConn{}
+	s := NewSubscriber(ctx, oc)
+	handler := func(p *person) {}
+	subs, err := s.SubscribeFunc(map[string]interface{}{
+		"orders.created": handler,
+		"audit.log":      handler,
+		"Orders.Created": handler,
+		"billing.paid":   handler,
+	})
+	assert.ErrorIs(t, err, ErrDuplicateSubject)
+	assert.Contains(t, err.Error(), `"Orders.Created" and "orders.created"`)
+	assert.Equal(t, []string{"Orders.Created", "audit.log", "billing.paid"}, oc.order)
+	assert.Len(t, subs, 3)
+}
+
+func TestSubscribeFuncNamed(t *testing.T) {
+	opts := []Option{WithSubjectPrefix("tenant"), WithNamingStyle(NamingKebab)}
+	methods := &fakeConn{}
+	assert.NoError(t, NewSubscriber(ctx, methods, opts...).Subscribe(&someService{}))
+
+	funcs := &fakeConn{}
+	svc := &someService{}
+	err := NewSubscriber(ctx, funcs, opts...).SubscribeFuncNamed("someservice", map[string]interface{}{
+		"Action1Message":      svc.Action1Message,
+		"Action2MessageQueue": svc.Action2MessageQueue,
+		"Helper":              func(p *person) {},
+	})
+	assert.ErrorContains(t, err, "someservice.Helper")
+	assert.Equal(t, methods.subjects, funcs.subjects)
+}
+
+func TestHealthy(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	ok, failed := s.Healthy()
+	assert.True(t, ok)
+	assert.Empty(t, failed)
+
+	fc.err = errors.New("not connected")
+	assert.Error(t, s.Subscribe(&someService{}))
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.Error(t, err)
+	ok, failed = s.Healthy()
+	assert.False(t, ok)
+	assert.Equal(t, []string{"other.action", "someservice.action1", "someservice.action2"}, failed)
+
+	fc.err = nil
+	assert.NoError(t, s.Subscribe(&someService{}))
+	ok, failed = s.Healthy()
+	assert.False(t, ok)
+	assert.Equal(t, []string{"other.action"}, failed)
+}
+
+type regionalService struct{ someService }
+
+func (*regionalService) QueueGroups(method string) []string {
+	return []string{"global", "eu"}
+}
+
+func TestSubscribeQueueGroups(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithNoDuplicates())
+	assert.NoError(t, s.Subscribe(&regionalService{}))
+	assert.Equal(t, []string{
+		"regionalservice.action1",
+		"regionalservice.action2@eu",
+		"regionalservice.action2@global",
+	}, fc.subjects)
+
+	err := s.Subscribe(&regionalService{})
+	assert.ErrorIs(t, err, ErrDuplicateSubject)
+	assert.Len(t, fc.subjects, 3)
+
+	assert.NoError(t, s.Unsubscribe(&regionalService{}))
+	assert.Empty(t, s.Subscriptions())
+}
+
+func TestManualTeardown(t *testing.T) {
+	handlers := make(map[string]interface{})
+	for i := 0; i < 200; i++ {
+		handlers[fmt.Sprintf("fan.out%d", i)] = func(p *person) {}
+	}
+	goroutines := func(opts ...Option) int {
+		s := NewSubscriber(ctx, &fakeConn{}, opts...)
+		before := runtime.NumGoroutine()
+		_, err := s.SubscribeFunc(handlers)
+		assert.NoError(t, err)
+		n := runtime.NumGoroutine() - before
+		assert.NoError(t, s.Close())
+		assert.Empty(t, s.Subscriptions())
+		return n
+	}
+	// a single watcher tears down all of them, and none is needed with manual teardown
+	assert.Less(t, goroutines(), 10)
+	assert.Less(t, goroutines(WithManualTeardown()), 10)
+}
+
+func TestTeardownWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSubscriber(ctx, &fakeConn{})
+	assert.NoError(t, s.Subscribe(&someService{}))
+	cancel()
+	s.Wait()
+	assert.Empty(t, s.Subscriptions())
+
+	// subscriptions made after the cancelation get torn down too
+	assert.NoError(t, s.Subscribe(&eventService{}))
+	s.Wait()
+	assert.Empty(t, s.Subscriptions())
+}
+
+func TestSubscribeFuncEntries(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithLogger(nopLogger{}))
+	handler := func(p *person) {}
+	subs, err := s.SubscribeFunc(map[string]interface{}{
+		"orders.created": handler,
+		"orders.paid":    FuncEntry{Handler: handler, Queue: "billing"},
+		"orders.sent":    &FuncEntry{Subject: "ignored", Handler: handler, Queue: "shipping"},
+		"orders.stream":  FuncEntry{Handler: handler, Opts: []nats.SubOpt{nats.DeliverNew()}},
+	}, "orders")
+	assert.ErrorIs(t, err, ErrUnsupportedConn)
+	assert.Len(t, subs, 3)
+	assert.Equal(t, []string{
+		"orders.created@orders",
+		"orders.paid@billing",
+		"orders.sent@shipping",
+	}, fc.subjects)
+}
+
+func TestUnsubscribeService(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithNoDuplicates())
+	assert.NoError(t, s.Subscribe(&someService{}))
+	assert.NoError(t, s.Subscribe(&eventService{}))
+	assert.NoError(t, s.Unsubscribe(&someService{}))
+	for _, sub := range s.Subscriptions() {
+		assert.Equal(t, "eventservice", strings.Split(sub.Subject, ".")[0])
+	}
+	assert.NoError(t, s.Subscribe(&someService{}))
+
+	_, err := s.SubscribeFunc(map[string]interface{}{"other.action": func(p *person) {}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Unsubscribe(&someService{}))
+	err = s.Unsubscribe(&someService{})
+	assert.ErrorIs(t, err, ErrNotSubscribed)
+	assert.Contains(t, err.Error(), "someservice.action1")
+	assert.Contains(t, err.Error(), "someservice.action2")
+}
+
+type versionedService struct{ version *string }
+
+func (vs *versionedService) NoteMessage(p *person) { *vs.version = p.Name }
+
+func TestReplace(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithNoDuplicates())
+	var got string
+	v1 := &versionedService{&got}
+	assert.NoError(t, s.Subscribe(v1))
+	assert.NoError(t, s.Subscribe(&eventService{}))
+	before, _ := s.SubscriptionFor("versionedservice.note")
+
+	v2 := &versionedService{new(string)}
+	assert.NoError(t, s.Replace(v1, v2))
+	assert.Len(t, s.Subscriptions(), 2)
+	after, ok := s.SubscriptionFor("versionedservice.note")
+	assert.True(t, ok)
+	assert.NotSame(t, before, after)
+
+	fc.handlers["versionedservice.note"].(func(*nats.Msg))(msg("versionedservice.note", "", &person{Name: "v2"}))
+	assert.Empty(t, got)
+	assert.Equal(t, "v2", *v2.version)
+	assert.ErrorIs(t, s.Subscribe(v1), ErrDuplicateSubject)
+}
+
+func TestReplaceKeepsOldOnFailure(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithLogger(nopLogger{}))
+	v1 := &versionedService{new(string)}
+	assert.NoError(t, s.Subscribe(v1))
+	before, _ := s.SubscriptionFor("versionedservice.note")
+
+	fc.err = errors.New("no connection")
+	assert.Error(t, s.Replace(v1, &versionedService{new(string)}))
+	sub, _ := s.SubscriptionFor("versionedservice.note")
+	assert.Same(t, before, sub)
+}
+
+func TestBuilder(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithSubjectPrefix("tenant"), WithNoDuplicates())
+	var got []string
+	err := s.Handler().
+		Service("timeservice").
+		Message("tick", Typed(func(p *person) { got = append(got, "tick "+p.Name) })).
+		Queue("work").
+		MessageQueue("job", func(subject string, p *person) { got = append(got, subject) }).
+		Service("clock").
+		MessageQueue("sync", Typed(func(p *person) {})).
+		Subscribe()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"tenant.clock.sync@clock_sync",
+		"tenant.timeservice.job@work",
+		"tenant.timeservice.tick",
+	}, fc.subjects)
+
+	fc.handlers["tenant.timeservice.tick"].(func(*nats.Msg))(msg("tenant.timeservice.tick", "", &person{Name: "dc0d"}))
+	fc.handlers["tenant.timeservice.job"].(func(*nats.Msg))(msg("tenant.timeservice.job", "", &person{}))
+	assert.Equal(t, []string{"tick dc0d", "tenant.timeservice.job"}, got)
+
+	err = s.Handler().Service("timeservice").Message("tick", Typed(func(p *person) {})).Message("", nil).Subscribe()
+	assert.ErrorIs(t, err, ErrDuplicateSubject)
+	assert.Contains(t, err.Error(), "empty name")
+}
+
+func TestSubscribeFallback(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+	assert.NoError(t, s.Subscribe(&someService{}))
+	_, err := s.SubscribeFunc(map[string]interface{}{"someservice.audit.*": func(m *nats.Msg) {}})
+	assert.NoError(t, err)
+
+	var got []string
+	assert.NoError(t, s.SubscribeFallback("someservice.>", func(subject string, m *nats.Msg) {
+		got = append(got, subject)
+	}))
+	fallback := fc.handlers["someservice.>"].(func(*nats.Msg))
+	for _, subject := range []string{
+		"someservice.action1",
+		"someservice.action3",
+		"someservice.audit.login",
+		"someservice.audit.login.failed",
+	} {
+		fallback(&nats.Msg{Subject: subject})
+	}
+	assert.Equal(t, []string{"someservice.action3", "someservice.audit.login.failed"}, got)
+}
+
+func TestSubscribeFallbackOverlap(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithDeadlineHeader("X-Deadline"), WithDeadLetter("dlq.{subject}"), WithLogger(nopLogger{}))
+	_, err := s.SubscribeFunc(map[string]interface{}{"orders.created": func(m *nats.Msg) {}})
+	assert.NoError(t, err)
+
+	var got []string
+	for _, subject := range []string{"orders.>", ">"} {
+		subject := subject
+		assert.NoError(t, s.SubscribeFallback(subject, func(string, *nats.Msg) { got = append(got, subject) }))
+	}
+	deliver := func(m *nats.Msg) {
+		for _, pattern := range []string{"orders.created", "orders.>", ">"} {
+			if subjectMatches(pattern, m.Subject) {
+				fc.handlers[pattern].(func(*nats.Msg))(m)
+			}
+		}
+	}
+	for _, subject := range []string{"orders.x", "audit.x", "orders.created"} {
+		deliver(&nats.Msg{Subject: subject})
+	}
+	assert.Equal(t, []string{"orders.>", ">"}, got)
+
+	deliver(&nats.Msg{Subject: "orders.created", Header: nats.Header{"X-Deadline": []string{"1"}}})
+	assert.Len(t, fc.published["dlq.orders.created"], 1)
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats["orders.>"].Received)
+	assert.Equal(t, uint64(1), stats[">"].Received)
+}
+
+func TestSubjectMatches(t *testing.T) {
+	for _, c := range []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"*.b", "a.b", true},
+		{"a.b.c", "a.b", false},
+	} {
+		assert.Equal(t, c.match, subjectMatches(c.pattern, c.subject), "%s %s", c.pattern, c.subject)
+	}
+}
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := NewSubscriber(ctx, &fakeConn{}, WithLogger(nopLogger{}))
+	assert.NoError(t, s.Subscribe(&someService{}))
+	assert.Len(t, s.Subscriptions(), 2)
+	cancel()
+	s.Wait()
+	assert.Empty(t, s.Subscriptions())
+}
+
+type fanInService struct{ subjects *[]string }
+
+func (fs fanInService) OrdersAllMessage(subject string, p *person) {
+	*fs.subjects = append(*fs.subjects, subject)
+}
+func (fanInService) AuditAllMessage(p *person) {}
+func (fanInService) AllMessage(p *person)      {}
+
+func TestSubscribeWildcardMarker(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithWildcardMarker("All"), WithStrictSignatures())
+	var subjects []string
+	err := s.Subscribe(fanInService{&subjects})
+	assert.ErrorIs(t, err, ErrUnsupportedSignature)
+	assert.Contains(t, err.Error(), "AuditAllMessage binds a wildcard subject")
+	assert.Equal(t, []string{"faninservice.all", "faninservice.orders.>"}, fc.subjects)
+
+	fc.handlers["faninservice.orders.>"].(func(*nats.Msg))(msg("faninservice.orders.created", "", &person{}))
+	assert.Equal(t, []string{"faninservice.orders.created"}, subjects)
+}
@@ -0,0 +1,117 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNoReply is returned by Respond, for messages without a reply subject,
+// and for JetStream messages, whose reply subject is used for acknowledging them.
+var ErrNoReply = errors.New("subly: message has no reply subject")
+
+type contextKey struct{}
+
+// FromContext returns the *Context of the message being handled, carried by the
+// context passed to handlers taking a context.Context.
+func FromContext(ctx context.Context) (*Context, bool) {
+	c, ok := ctx.Value(contextKey{}).(*Context)
+	return c, ok
+}
+
+// ReplySubject returns the reply subject of the message being handled, if any,
+// from the context passed to handlers taking a context.Context. JetStream messages
+// have none, as their reply subject is used for acknowledging them.
+func ReplySubject(ctx context.Context) (string, bool) {
+	c, ok := FromContext(ctx)
+	if !ok || c.Reply() == "" {
+		return "", false
+	}
+	return c.Reply(), true
+}
+
+// Respond publishes v to the reply subject of the message being handled, from the
+// context passed to handlers taking a context.Context, for replying conditionally
+// instead of returning a value. It returns ErrNoReply when there is no reply subject,
+// or on a JetStream subscriber.
+func Respond(ctx context.Context, v interface{}) error {
+	c, ok := FromContext(ctx)
+	if !ok {
+		return fmt.Errorf("%w: not a handler context", ErrNoReply)
+	}
+	return c.Respond(v)
+}
+
+// Context is passed to handlers taking it before the message, as in
+// func(c *subly.Context, p *person). It describes the message being handled
+// and publishes using the connection of the Subscriber.
+type Context struct {
+	ctx     context.Context
+	msg     *nats.Msg
+	s       *Subscriber
+	replied int32
+}
+
+// withContext returns ctx carrying a new *Context for m, or the one it already
+// carries for m, see WithReplyContext, bound to ctx.
+func (s *Subscriber) withContext(ctx context.Context, m *nats.Msg) (context.Context, *Context) {
+	c, ok := FromContext(ctx)
+	if !ok || c.msg != m {
+		c = &Context{msg: m, s: s}
+	}
+	ctx = context.WithValue(ctx, contextKey{}, c)
+	c.ctx = ctx
+	return ctx, c
+}
+
+// responded reports whether Respond was called successfully on c.
+func (c *Context) responded() bool {
+	return c != nil && atomic.LoadInt32(&c.replied) == 1
+}
+
+// Context returns the context of the Subscriber, bounded by the handler timeout if one is set.
+func (c *Context) Context() context.Context { return c.ctx }
+
+// Subject returns the subject the message arrived on.
+func (c *Context) Subject() string { return c.msg.Subject }
+
+// Reply returns the reply subject of the message, if any, and none on a JetStream
+// subscriber, where it is the ack subject.
+func (c *Context) Reply() string {
+	if c.s.jetStream {
+		return ""
+	}
+	return c.msg.Reply
+}
+
+// Header returns the headers of the message, if any.
+func (c *Context) Header() nats.Header { return c.msg.Header }
+
+// Msg returns the raw message.
+func (c *Context) Msg() *nats.Msg { return c.msg }
+
+// Publish publishes v to subject, as is, using the connection of the Subscriber.
+func (c *Context) Publish(subject string, v interface{}) error {
+	return c.s.conn.Publish(subject, v)
+}
+
+// Respond publishes v to the reply subject of the message. Once it did, a value
+// returned by the handler does not get published as a reply again.
+//
+// On a JetStream subscriber it returns ErrNoReply, as the reply subject is the ack subject.
+func (c *Context) Respond(v interface{}) error {
+	if c.s.jetStream {
+		return fmt.Errorf("%w: jetstream message", ErrNoReply)
+	}
+	if c.msg.Reply == "" {
+		return ErrNoReply
+	}
+	if err := c.s.publishReply(c.msg, v); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.replied, 1)
+	return nil
+}
@@ -0,0 +1,46 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrExpired is returned for messages which arrive after the deadline in their
+// deadline header, see WithDeadlineHeader. Their handler is not invoked.
+var ErrExpired = errors.New("subly: message expired")
+
+// deadline drops the messages whose deadline passed, and bounds the context of the
+// others by their deadline.
+func (s *Subscriber) deadline(subject string, h MsgHandler) MsgHandler {
+	return func(ctx context.Context, m *nats.Msg) error {
+		v := m.Header.Get(s.opts.deadlineHeader)
+		if v == "" {
+			return h(ctx, m)
+		}
+		deadline, err := parseDeadline(v)
+		if err != nil {
+			s.opts.logf(LogWarn, "subly: deadline of message on %q: %v", subject, err)
+			return h(ctx, m)
+		}
+		if !time.Now().Before(deadline) {
+			s.opts.logf(LogInfo, "subly: skip message on %q, expired at %v", subject, deadline)
+			return fmt.Errorf("%w at %v", ErrExpired, deadline)
+		}
+		ctx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		return h(ctx, m)
+	}
+}
+
+// parseDeadline parses an RFC 3339 timestamp, or a Unix time in milliseconds.
+func parseDeadline(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
@@ -0,0 +1,64 @@
+package subly
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// seenIDs remembers message IDs for a window, dropping the expired ones
+// at most once per window.
+type seenIDs struct {
+	mu     sync.Mutex
+	window time.Duration
+	ids    map[string]time.Time // id -> when it was seen
+	pruned time.Time
+}
+
+// add records id, reporting false if it was already seen within the window.
+func (c *seenIDs) add(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.pruned) >= c.window {
+		for k, at := range c.ids {
+			if now.Sub(at) >= c.window {
+				delete(c.ids, k)
+			}
+		}
+		c.pruned = now
+	}
+	if at, ok := c.ids[id]; ok && now.Sub(at) < c.window {
+		return false
+	}
+	c.ids[id] = now
+	return true
+}
+
+func (c *seenIDs) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, id)
+}
+
+// dedup skips the messages on subject whose ID header was already seen within the window,
+// as handled successfully or being handled. Messages without an ID are always handled.
+func (s *Subscriber) dedup(subject string, h MsgHandler) MsgHandler {
+	seen := &seenIDs{window: s.opts.dedupWindow, ids: make(map[string]time.Time)}
+	return func(ctx context.Context, m *nats.Msg) error {
+		id := m.Header.Get(s.opts.dedupHeader)
+		if id == "" {
+			return h(ctx, m)
+		}
+		if !seen.add(id, time.Now()) {
+			s.opts.logf(LogInfo, "subly: skip duplicate %q on %q", id, subject)
+			return nil
+		}
+		err := h(ctx, m)
+		if err != nil {
+			seen.remove(id)
+		}
+		return err
+	}
+}
@@ -0,0 +1,66 @@
+package subly
+
+import (
+	"sync/atomic"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+// Event types, in the lifecycle of a subscription.
+const (
+	EventSubscribed EventType = iota
+	EventResubscribed
+	EventDrained
+	EventUnsubscribed
+	EventPaused
+	EventResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSubscribed:
+		return "subscribed"
+	case EventResubscribed:
+		return "resubscribed"
+	case EventDrained:
+		return "drained"
+	case EventUnsubscribed:
+		return "unsubscribed"
+	case EventPaused:
+		return "paused"
+	case EventResumed:
+		return "resumed"
+	}
+	return "unknown"
+}
+
+// Event reports a change in the lifecycle of a subscription, see Subscriber.Events.
+// Err is set when the change failed.
+type Event struct {
+	Type    EventType
+	Subject string
+	Err     error
+}
+
+// eventBuffer is the capacity of the events channel.
+const eventBuffer = 64
+
+// Events returns the channel on which the lifecycle of subscriptions gets reported.
+// It is buffered, and events get dropped when nobody reads them, see DroppedEvents.
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// DroppedEvents returns the number of events dropped because the events channel was full.
+func (s *Subscriber) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&s.droppedEvents)
+}
+
+func (s *Subscriber) emit(t EventType, subject string, err error) {
+	select {
+	case s.events <- Event{Type: t, Subject: subject, Err: err}:
+	default:
+		atomic.AddUint64(&s.droppedEvents, 1)
+	}
+}
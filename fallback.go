@@ -0,0 +1,114 @@
+package subly
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SubscribeFallback subscribes handler to subject, usually a wildcard like "orders.>",
+// for the messages which no more specific subscription of this Subscriber handles,
+// like for logging unexpected traffic or routing generically. The subject prefix applies.
+//
+// NATS delivers a message to every matching subscription, so each message on subject
+// gets checked against the other subscriptions of the Subscriber, including paused ones,
+// and skipped, before any middleware, if one of them matches. When fallbacks overlap,
+// like on "orders.>" and ">", only the most specific one gets the message. Subscriptions
+// made by other Subscribers or connections are not known.
+func (s *Subscriber) SubscribeFallback(subject string, handler func(subject string, m *nats.Msg)) error {
+	subject = s.opts.prefixed(subject)
+	if err := s.validate(subject, subject); err != nil {
+		return s.noteBind(subject, err)
+	}
+	if err := s.claim(subject, subject); err != nil {
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	cb := s.dispatch(subject, func(ctx context.Context, m *nats.Msg) error {
+		handler(m.Subject, m)
+		return nil
+	}, true, func(m *nats.Msg) (interface{}, error) { return m, nil })
+	s.mu.Lock()
+	if s.fallbacks == nil {
+		s.fallbacks = make(map[string]bool)
+	}
+	s.fallbacks[subject] = true
+	s.mu.Unlock()
+	_, err := s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return s.conn.Subscribe(subject, func(m *nats.Msg) {
+			if !s.handled(subject, m.Subject) {
+				cb(m)
+				return
+			}
+			if s.jetStream && s.opts.manualAck {
+				s.ack(m, nil)
+			}
+		})
+	}))
+	if err != nil {
+		s.release(subject)
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	return s.flushAfter(s.noteBind(subject, nil))
+}
+
+// handled reports whether a subscription, other than to fallback, matches subject.
+// Other fallbacks only count when they are more specific than fallback.
+func (s *Subscriber) handled(fallback, subject string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.subs {
+		pattern := e.sub.Subject
+		if pattern == fallback || !subjectMatches(pattern, subject) {
+			continue
+		}
+		if !s.fallbacks[pattern] || moreSpecific(pattern, fallback) {
+			return true
+		}
+	}
+	return false
+}
+
+// moreSpecific reports whether pattern a is more specific than pattern b: it has more
+// tokens before a trailing >, or as many and more literal tokens. Ties are broken by
+// comparing the patterns, so exactly one of overlapping patterns wins.
+func moreSpecific(a, b string) bool {
+	score := func(pattern string) (tokens, literals int) {
+		for _, t := range strings.Split(pattern, ".") {
+			switch t {
+			case ">":
+			case "*":
+				tokens++
+			default:
+				tokens++
+				literals++
+			}
+		}
+		return tokens, literals
+	}
+	at, al := score(a)
+	bt, bl := score(b)
+	if at != bt {
+		return at > bt
+	}
+	if al != bl {
+		return al > bl
+	}
+	return a < b
+}
+
+// subjectMatches reports whether subject matches pattern, which may contain the
+// * and > wildcards.
+func subjectMatches(pattern, subject string) bool {
+	pts := strings.Split(pattern, ".")
+	sts := strings.Split(subject, ".")
+	for i, pt := range pts {
+		if pt == ">" {
+			return len(sts) > i
+		}
+		if i >= len(sts) || (pt != "*" && pt != sts[i]) {
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
@@ -0,0 +1,824 @@
+package subly
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/encoders/builtin"
+	"golang.org/x/time/rate"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	msgType     = reflect.TypeOf((*nats.Msg)(nil))
+	subCtxType  = reflect.TypeOf((*Context)(nil))
+	stringType  = reflect.TypeOf("")
+)
+
+// ErrorReply is published to the reply subject, when a handler returns an error.
+type ErrorReply struct {
+	Error string `json:"error"`
+}
+
+// ErrorHeader carries the error of a handler, on replies for encodings which
+// cannot encode an ErrorReply.
+const ErrorHeader = "Nats-Service-Error"
+
+// DeadLetter is published to the dead-letter subject, see WithDeadLetter,
+// when handling a message fails.
+type DeadLetter struct {
+	Subject string `json:"subject"`
+	Error   string `json:"error"`
+	Data    []byte `json:"data"`
+}
+
+// MessageError is passed to the error encoder, see WithErrorEncoder, for dead letters.
+// It carries the message which failed along with the error.
+type MessageError struct {
+	Subject string
+	Data    []byte
+	Err     error
+}
+
+func (e *MessageError) Error() string { return fmt.Sprintf("subly: handle %q: %v", e.Subject, e.Err) }
+
+// Unwrap returns the error of the handler.
+func (e *MessageError) Unwrap() error { return e.Err }
+
+// MsgHandler handles a message, see Middleware.
+type MsgHandler func(ctx context.Context, m *nats.Msg) error
+
+// Middleware wraps the handling of each message. It has access to the raw
+// message, including its headers, can enrich the context which gets passed to
+// context-aware handlers, and sees the error returned by the handler.
+type Middleware func(next MsgHandler) MsgHandler
+
+// ErrUnsupportedSignature is returned, wrapped with the name of the handler,
+// for handlers with a signature that is not described in package documentation.
+var ErrUnsupportedSignature = errors.New("subly: unsupported handler signature")
+
+// callback is a handler func, along with the shape of its signature.
+type callback struct {
+	fn      reflect.Value
+	withCtx bool
+	lead    reflect.Type // type of the first of two arguments: string, *nats.Msg or *Context
+	numArgs int          // not counting the context, 1, 2 or 3
+	argType reflect.Type // type of the last argument, the message
+	numOut  int
+	withErr bool // last result is an error
+}
+
+// parseCallback reports whether fn has one of the supported signatures:
+// an optional leading context.Context, followed by one of (*nats.Msg), (o), (subject, o),
+// (subject, reply, o), (*nats.Msg, o) or (*Context, o), returning nothing, a value,
+// an error or a value and an error.
+func parseCallback(fn interface{}) (*callback, error) {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.IsVariadic() {
+		return nil, ErrUnsupportedSignature
+	}
+	var in []reflect.Type
+	for i := 0; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	cb := &callback{fn: reflect.ValueOf(fn), numOut: t.NumOut()}
+	if len(in) > 1 && in[0] == contextType {
+		cb.withCtx = true
+		in = in[1:]
+	}
+	if len(in) > 0 && in[len(in)-1] == contextType {
+		return nil, ErrUnsupportedSignature
+	}
+	switch len(in) {
+	case 1:
+	case 2:
+		if in[0] != stringType && in[0] != msgType && in[0] != subCtxType {
+			return nil, ErrUnsupportedSignature
+		}
+		cb.lead = in[0]
+	case 3:
+		if in[0] != stringType || in[1] != stringType {
+			return nil, ErrUnsupportedSignature
+		}
+	default:
+		return nil, ErrUnsupportedSignature
+	}
+	cb.numArgs = len(in)
+	cb.argType = in[len(in)-1]
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		cb.withErr = t.Out(0) == errorType
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, ErrUnsupportedSignature
+		}
+		cb.withErr = true
+	default:
+		return nil, ErrUnsupportedSignature
+	}
+	return cb, nil
+}
+
+func checkSignature(fn interface{}) error {
+	_, err := parseCallback(fn)
+	return err
+}
+
+// IsSupported reports whether handler is a func with one of the signatures
+// described in package documentation, so it can get subscribed.
+func IsSupported(handler interface{}) bool {
+	return checkSignature(handler) == nil
+}
+
+// SupportedSignatures returns the supported handler signatures, with interface{}
+// standing for the type of the message and of the returned value, which can be any type.
+func SupportedSignatures() []reflect.Type {
+	anyType := reflect.TypeOf((*interface{})(nil)).Elem()
+	ins := [][]reflect.Type{
+		{msgType},
+		{anyType},
+		{stringType, anyType},
+		{stringType, stringType, anyType},
+		{msgType, anyType},
+		{subCtxType, anyType},
+	}
+	outs := [][]reflect.Type{
+		nil,
+		{anyType},
+		{errorType},
+		{anyType, errorType},
+	}
+	var sigs []reflect.Type
+	for _, in := range ins {
+		for _, lead := range [][]reflect.Type{nil, {contextType}} {
+			args := append(append([]reflect.Type(nil), lead...), in...)
+			for _, out := range outs {
+				sigs = append(sigs, reflect.FuncOf(args, out, false))
+			}
+		}
+	}
+	return sigs
+}
+
+// check validates the signature of the handler fn, named name. Unsupported
+// signatures get logged, or returned as an error in strict mode.
+func (s *Subscriber) check(name string, fn interface{}) error {
+	if checkSignature(fn) == nil {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s has %T", ErrUnsupportedSignature, name, fn)
+	if s.opts.strictSignatures {
+		return err
+	}
+	s.opts.logf(LogWarn, "%v", err)
+	return nil
+}
+
+// checkWildcard validates that the handler fn, named name, bound to a wildcard
+// subject, can tell which subject a message arrived on, by taking the subject
+// or the *nats.Msg. Otherwise it gets logged, or returned as an error in strict mode.
+func (s *Subscriber) checkWildcard(name string, fn interface{}) error {
+	cb, err := parseCallback(fn)
+	if err != nil || cb.numArgs > 1 || cb.argType == msgType {
+		return nil
+	}
+	err = fmt.Errorf("%w: %s binds a wildcard subject, but does not take the subject", ErrUnsupportedSignature, name)
+	if s.opts.strictSignatures {
+		return err
+	}
+	s.opts.logf(LogWarn, "%v", err)
+	return nil
+}
+
+// ErrUndecodablePayload is returned, in strict mode, for handlers whose payload type
+// can never get decoded from JSON.
+var ErrUndecodablePayload = errors.New("subly: payload type can not be decoded")
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkPayload validates that the payload type of the handler fn, named name, can get
+// decoded, when the encoder is the JSON one. Otherwise it gets logged, or returned as
+// an error in strict mode, since such messages would fail to decode, or decode to zero values.
+func (s *Subscriber) checkPayload(name string, fn interface{}) error {
+	cb, err := parseCallback(fn)
+	if err != nil || cb.argType == msgType {
+		return nil
+	}
+	if _, ok := s.enc.(*builtin.JsonEncoder); !ok {
+		return nil
+	}
+	reason := undecodable(cb.argType)
+	if reason == "" {
+		return nil
+	}
+	err = fmt.Errorf("%w: %s takes %v, %s", ErrUndecodablePayload, name, cb.argType, reason)
+	if s.opts.strictSignatures {
+		return err
+	}
+	s.opts.logf(LogWarn, "%v", err)
+	return nil
+}
+
+// undecodable returns why values of t can not get decoded from JSON, if so.
+func undecodable(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pt := reflect.PointerTo(t)
+	if pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType) {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return "which JSON does not support"
+	case reflect.Struct:
+		if t.NumField() == 0 {
+			return ""
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() || f.Anonymous {
+				return ""
+			}
+		}
+		return "which has no exported fields"
+	}
+	return ""
+}
+
+// handler builds the callback handed to NATS for fn, subscribed to subject.
+// Messages get decoded by subly, using the encoder of the connection, so the
+// raw message is available to middlewares. Funcs with unsupported signatures
+// are handed to NATS as is.
+func (s *Subscriber) handler(subject string, fn interface{}) interface{} {
+	cb, err := parseCallback(fn)
+	if err != nil {
+		return fn
+	}
+	takesMsg := cb.lead == msgType || cb.argType == msgType
+	payload := func(m *nats.Msg) (interface{}, error) {
+		if cb.argType == msgType {
+			return m, nil
+		}
+		v, err := s.decode(cb.argType, m)
+		if err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	return s.dispatch(subject, func(ctx context.Context, m *nats.Msg) error {
+		return s.invoke(ctx, cb, m)
+	}, !takesMsg, payload)
+}
+
+// dispatch returns the func(*nats.Msg) handed to NATS, which runs h through
+// the configured middlewares, recovering from panics and honoring the max concurrency,
+// the worker pool and the partition key of subject, which gets the value returned by payload.
+// With manual acks, the message gets acknowledged based on the result of h, if ack is set.
+func (s *Subscriber) dispatch(subject string, h MsgHandler, ack bool, payload func(*nats.Msg) (interface{}, error)) func(*nats.Msg) {
+	h = s.chain(subject, h)
+	run := func(m *nats.Msg) {
+		defer func() {
+			if r := recover(); r != nil {
+				s.panicked(subject, r)
+			}
+		}()
+		ctx := s.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if s.opts.requestIDHeader != "" {
+			ctx = s.withRequestID(ctx, m)
+		}
+		if s.opts.replyContext {
+			ctx, _ = s.withContext(ctx, m)
+		}
+		err := h(ctx, m)
+		if ack && s.jetStream && s.opts.manualAck {
+			s.ack(m, err)
+		}
+	}
+	var slots chan struct{}
+	if s.opts.maxConcurrency > 0 {
+		slots = make(chan struct{}, s.opts.maxConcurrency)
+	}
+	if key, ok := s.opts.partitionKeys[subject]; ok {
+		if s.pool != nil {
+			inline := run
+			run = func(m *nats.Msg) {
+				s.pool <- struct{}{}
+				defer func() { <-s.pool }()
+				inline(m)
+			}
+		}
+		return s.partition(subject, key, payload, slots, run)
+	}
+	if slots == nil && s.pool == nil {
+		return run
+	}
+	return func(m *nats.Msg) {
+		if !s.inflight.add() {
+			s.opts.logf(LogInfo, "subly: skip message on %q, draining", subject)
+			return
+		}
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		if s.pool != nil {
+			s.pool <- struct{}{}
+		}
+		go func() {
+			defer s.inflight.done()
+			defer func() {
+				if s.pool != nil {
+					<-s.pool
+				}
+				if slots != nil {
+					<-slots
+				}
+			}()
+			run(m)
+		}()
+	}
+}
+
+// callbacks counts the callbacks running off the dispatch of their subscriptions,
+// for DrainWithTimeout to wait for them.
+type callbacks struct {
+	mu      sync.Mutex
+	running int
+	idle    chan struct{} // closed once none are running, after stop
+}
+
+// add counts a new callback, or reports false once stopped.
+func (c *callbacks) add() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle != nil {
+		return false
+	}
+	c.running++
+	return true
+}
+
+func (c *callbacks) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	if c.running == 0 && c.idle != nil {
+		close(c.idle)
+	}
+}
+
+// stop refuses new callbacks, and returns a channel which gets closed once
+// the running ones finished, along with how many are still running.
+func (c *callbacks) stop() (<-chan struct{}, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+		if c.running == 0 {
+			close(c.idle)
+		}
+	}
+	return c.idle, c.running
+}
+
+// chain wraps h with the configured middlewares, the first one being the outermost,
+// and with deadlines, dead-lettering, metrics and deduplication if configured,
+// recording the statistics of subject.
+// A panic inside h is recovered and returned as an error.
+func (s *Subscriber) chain(subject string, h MsgHandler) MsgHandler {
+	next := h
+	h = func(ctx context.Context, m *nats.Msg) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				s.panicked(subject, r)
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return next(ctx, m)
+	}
+	if l, ok := s.opts.rateLimit(subject); ok {
+		h = s.limit(subject, rate.NewLimiter(rate.Limit(l.rps), l.burst), h)
+	}
+	for i := len(s.opts.middlewares) - 1; i >= 0; i-- {
+		h = s.opts.middlewares[i](h)
+	}
+	if s.opts.deadlineHeader != "" {
+		h = s.deadline(subject, h)
+	}
+	if s.opts.deadLetter != "" {
+		h = s.deadLetter(h)
+	}
+	if s.opts.metrics != nil {
+		h = observe(s.opts.metrics, subject, h)
+	}
+	if s.opts.dedupWindow > 0 {
+		h = s.dedup(subject, h)
+	}
+	return s.count(subject, h)
+}
+
+// ack acknowledges m when handling it succeeded, and negatively acknowledges it
+// for redelivery otherwise, unless it expired, see WithDeadlineHeader.
+func (s *Subscriber) ack(m *nats.Msg, err error) {
+	var aerr error
+	switch {
+	case err == nil:
+		aerr = m.Ack()
+	case errors.Is(err, ErrExpired):
+		aerr = m.Term() // redelivering would not make it valid again
+	default:
+		aerr = m.Nak()
+	}
+	if aerr != nil {
+		s.opts.logf(LogError, "subly: acknowledge %q: %v", m.Subject, aerr)
+	}
+}
+
+// observe reports each invocation of h to m, along with the returned error, if any.
+func observe(m Metrics, subject string, h MsgHandler) MsgHandler {
+	return func(ctx context.Context, msg *nats.Msg) error {
+		start := time.Now()
+		err := h(ctx, msg)
+		m.Observe(subject, time.Since(start), err)
+		return err
+	}
+}
+
+// retry runs call, the invocation of a handler, again while it fails, up to the configured
+// attempts, unless the context gets canceled while waiting. With retries, a panic inside
+// call is recovered and counts as a failure. Decoding and validating the message
+// happen before, so their failures are not retried.
+func (s *Subscriber) retry(ctx context.Context, subject string, call func() error) error {
+	attempt := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				s.panicked(subject, r)
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return call()
+	}
+	if s.opts.retries <= 0 {
+		return call()
+	}
+	err := attempt()
+	for n := 1; err != nil && n <= s.opts.retries; n++ {
+		if ctx.Err() != nil {
+			return err
+		}
+		var wait time.Duration
+		if s.opts.backoff != nil {
+			wait = s.opts.backoff(n)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = attempt()
+	}
+	return err
+}
+
+// ErrRateLimited is returned for the messages dropped by WithRateLimit.
+var ErrRateLimited = errors.New("subly: rate limited")
+
+// limit delays each invocation of h until l allows it. When the wait is canceled, or would
+// outlast the handler timeout if one is set, the message is dropped with ErrRateLimited.
+func (s *Subscriber) limit(subject string, l *rate.Limiter, h MsgHandler) MsgHandler {
+	return func(ctx context.Context, m *nats.Msg) error {
+		wctx := ctx
+		if s.opts.handlerTimeout > 0 {
+			var cancel context.CancelFunc
+			wctx, cancel = context.WithTimeout(ctx, s.opts.handlerTimeout)
+			defer cancel()
+		}
+		if err := l.Wait(wctx); err != nil {
+			err = fmt.Errorf("%w: %v", ErrRateLimited, err)
+			s.opts.logf(LogWarn, "subly: drop message on %q: %v", subject, err)
+			if s.opts.errorHandler != nil {
+				s.opts.errorHandler(subject, err)
+			}
+			return err
+		}
+		return h(ctx, m)
+	}
+}
+
+// deadLetter publishes the messages which h fails to handle to the dead-letter subject.
+func (s *Subscriber) deadLetter(h MsgHandler) MsgHandler {
+	return func(ctx context.Context, m *nats.Msg) error {
+		err := h(ctx, m)
+		if err == nil {
+			return nil
+		}
+		subject := strings.ReplaceAll(s.opts.deadLetter, "{subject}", m.Subject)
+		var dl interface{} = &DeadLetter{Subject: m.Subject, Error: err.Error(), Data: m.Data}
+		if s.opts.errorEncoder != nil {
+			dl = s.opts.errorEncoder(&MessageError{Subject: m.Subject, Data: m.Data, Err: err})
+		}
+		if perr := s.conn.Publish(subject, dl); perr != nil {
+			s.opts.logf(LogError, "subly: dead letter to %q: %v", subject, perr)
+		}
+		return err
+	}
+}
+
+// invoke decodes m and calls cb, with the context enriched by the context func
+// and bounded by the handler timeout if set, and replies with its results.
+func (s *Subscriber) invoke(ctx context.Context, cb *callback, m *nats.Msg) error {
+	var args []reflect.Value
+	takesCtx := cb.withCtx || cb.lead == subCtxType
+	if takesCtx && s.opts.contextFunc != nil {
+		ctx = s.opts.contextFunc(ctx, m)
+	}
+	var sc *Context
+	if takesCtx {
+		ctx, sc = s.withContext(ctx, m)
+	} else if c, ok := FromContext(ctx); ok && c.msg == m {
+		sc = c
+	}
+	if cb.withCtx {
+		args = append(args, reflect.Value{}) // the context of each attempt
+	}
+	switch {
+	case cb.lead == msgType:
+		args = append(args, reflect.ValueOf(m))
+	case cb.lead == subCtxType:
+		args = append(args, reflect.ValueOf(sc))
+	case cb.numArgs == 2:
+		args = append(args, reflect.ValueOf(m.Subject))
+	case cb.numArgs == 3:
+		args = append(args, reflect.ValueOf(m.Subject), reflect.ValueOf(m.Reply))
+	}
+	if cb.argType == msgType {
+		s.audit(m.Subject, m)
+		args = append(args, reflect.ValueOf(m))
+	} else {
+		arg, err := s.decode(cb.argType, m)
+		if err != nil {
+			s.decodeFailed(m, err)
+			return err
+		}
+		if err := s.validatePayload(m.Subject, arg.Interface()); err != nil {
+			return err
+		}
+		s.audit(m.Subject, arg.Interface())
+		args = append(args, arg)
+	}
+
+	var out []reflect.Value
+	err := s.retry(ctx, m.Subject, func() error {
+		actx := ctx
+		if takesCtx && s.opts.handlerTimeout > 0 {
+			var cancel context.CancelFunc
+			actx, cancel = context.WithTimeout(ctx, s.opts.handlerTimeout)
+			defer cancel()
+			actx, _ = s.withContext(actx, m)
+		}
+		if cb.withCtx {
+			cv := reflect.New(contextType).Elem()
+			cv.Set(reflect.ValueOf(actx))
+			args[0] = cv
+		}
+		out = cb.fn.Call(args)
+		return resultError(out)
+	})
+	if out == nil {
+		return err // the last attempt panicked
+	}
+	return s.reply(m, sc, out)
+}
+
+// resultError returns the error returned by a handler, if any.
+func resultError(out []reflect.Value) error {
+	if len(out) == 0 {
+		return nil
+	}
+	if last := out[len(out)-1]; last.Type() == errorType && !last.IsNil() {
+		return last.Interface().(error)
+	}
+	return nil
+}
+
+// audit passes a sample of the payloads to the audit func, if one is set.
+func (s *Subscriber) audit(subject string, payload interface{}) {
+	if s.opts.auditFunc == nil {
+		return
+	}
+	if s.opts.auditRate < 1 && rand.Float64() >= s.opts.auditRate {
+		return
+	}
+	s.opts.auditFunc(subject, payload)
+}
+
+// validatePayload runs the validator, if one is set, on the decoded payload.
+func (s *Subscriber) validatePayload(subject string, payload interface{}) error {
+	if s.opts.validator == nil {
+		return nil
+	}
+	if err := s.opts.validator(subject, payload); err != nil {
+		s.opts.logf(LogWarn, "subly: invalid message on %q: %v", subject, err)
+		return err
+	}
+	return nil
+}
+
+// decode decodes the data of m into a new value of type t, the same way
+// *nats.EncodedConn does for its callbacks.
+func (s *Subscriber) decode(t reflect.Type, m *nats.Msg) (reflect.Value, error) {
+	var v reflect.Value
+	if t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem())
+	} else {
+		v = reflect.New(t)
+	}
+	if err := s.unmarshal(m.Subject, m.Data, v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	if t.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	return v, nil
+}
+
+// unmarshal decodes data into v using the encoder, or a strict JSON decoder
+// when strict decoding is set and the encoder is the JSON one.
+func (s *Subscriber) unmarshal(subject string, data []byte, v interface{}) error {
+	if !s.opts.strictDecoding {
+		return s.enc.Decode(subject, data, v)
+	}
+	if _, ok := s.enc.(*builtin.JsonEncoder); !ok {
+		return s.enc.Decode(subject, data, v)
+	}
+	switch v.(type) {
+	case *string, *[]byte:
+		return s.enc.Decode(subject, data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data after JSON value")
+	}
+	return nil
+}
+
+// decodeFailed reports m, which could not be decoded, to the decode error handler if set,
+// and to the error handler as well when strict decoding is set.
+func (s *Subscriber) decodeFailed(m *nats.Msg, err error) {
+	s.opts.logf(LogWarn, "subly: decode message on %q: %v", m.Subject, err)
+	if s.opts.decodeErrorHandler != nil {
+		s.opts.decodeErrorHandler(m.Subject, m.Data, err)
+	}
+	if s.opts.strictDecoding && s.opts.errorHandler != nil {
+		s.opts.errorHandler(m.Subject, err)
+	}
+}
+
+// reply publishes the returned value, or an ErrorReply, to the reply subject of m,
+// unless sc already responded, and returns the returned error, if any. Nil values,
+// and nil payloads of the error encoder, are not published.
+func (s *Subscriber) reply(m *nats.Msg, sc *Context, out []reflect.Value) error {
+	if len(out) == 0 {
+		return nil
+	}
+	var (
+		payload interface{}
+		err     error
+	)
+	if last := out[len(out)-1]; last.Type() == errorType {
+		out = out[:len(out)-1]
+		if !last.IsNil() {
+			err = last.Interface().(error)
+			payload = &ErrorReply{Error: err.Error()}
+			if s.opts.errorEncoder != nil {
+				payload = s.opts.errorEncoder(err)
+			}
+		}
+	}
+	if err == nil && len(out) > 0 && !isNil(out[0]) {
+		payload = out[0].Interface()
+	}
+	if m.Reply == "" || payload == nil || s.jetStream || sc.responded() {
+		return err
+	}
+	perr := s.publishReply(m, payload)
+	if nc, ok := s.natsConn(); ok && perr != nil && err != nil {
+		r := s.replyMsg(m)
+		r.Header.Set(ErrorHeader, err.Error())
+		if perr = nc.PublishMsg(r); perr == nil {
+			perr = s.flushReply()
+		}
+	}
+	if perr != nil {
+		perr = fmt.Errorf("subly: reply to %q: %w", m.Reply, perr)
+		if s.opts.errorHandler != nil {
+			s.opts.errorHandler(m.Subject, perr)
+		} else {
+			s.opts.logf(LogError, "%v", perr)
+		}
+	}
+	return err
+}
+
+// isNil reports whether v is a nil pointer, map, slice or interface, which are not published as replies.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	case reflect.Interface:
+		return v.IsNil() || isNil(v.Elem())
+	}
+	return false
+}
+
+// publishReply publishes payload to the reply subject of m, encoded by the encoder
+// of the connection. The correlation header of m gets copied to the reply, when
+// the underlying *nats.Conn is available.
+func (s *Subscriber) publishReply(m *nats.Msg, payload interface{}) error {
+	nc, ok := s.natsConn()
+	if !ok || s.correlationID(m) == "" {
+		if err := s.conn.Publish(m.Reply, payload); err != nil {
+			return err
+		}
+		return s.flushReply()
+	}
+	data, err := s.encode(m.Reply, payload)
+	if err != nil {
+		return err
+	}
+	r := s.replyMsg(m)
+	r.Data = data
+	if err := nc.PublishMsg(r); err != nil {
+		return err
+	}
+	return s.flushReply()
+}
+
+// flushReply waits, up to the reply timeout if one is set, for the server
+// to receive the replies published so far.
+func (s *Subscriber) flushReply() error {
+	if s.opts.replyTimeout <= 0 {
+		return nil
+	}
+	f, ok := s.conn.(interface{ FlushTimeout(time.Duration) error })
+	if !ok {
+		return nil
+	}
+	return f.FlushTimeout(s.opts.replyTimeout)
+}
+
+// replyMsg returns an empty reply to m, carrying its correlation header, if any.
+func (s *Subscriber) replyMsg(m *nats.Msg) *nats.Msg {
+	r := nats.NewMsg(m.Reply)
+	if id := s.correlationID(m); id != "" {
+		r.Header.Set(s.opts.correlationHeader, id)
+	}
+	return r
+}
+
+func (s *Subscriber) correlationID(m *nats.Msg) string {
+	if s.opts.correlationHeader == "" || m.Header == nil {
+		return ""
+	}
+	return m.Header.Get(s.opts.correlationHeader)
+}
+
+// encode encodes v the way the connection would publish it.
+func (s *Subscriber) encode(subject string, v interface{}) ([]byte, error) {
+	if _, ok := s.conn.(*rawConn); ok {
+		if data, ok := v.([]byte); ok {
+			return data, nil
+		}
+	}
+	return s.enc.Encode(subject, v)
+}
+
+func (s *Subscriber) panicked(subject string, r interface{}) {
+	s.opts.logf(LogError, "subly: panic in handler for %q: %v", subject, r)
+	if s.opts.onPanic != nil {
+		s.opts.onPanic(subject, r)
+	}
+}
@@ -0,0 +1,893 @@
+package subly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+type recordLogger struct{ lines []string }
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// msg returns a message on subject, with v encoded as json.
+func msg(subject, reply string, v interface{}) *nats.Msg {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return &nats.Msg{Subject: subject, Reply: reply, Data: data}
+}
+
+func TestHandlerRecover(t *testing.T) {
+	var recovered []string
+	s := NewSubscriber(ctx, &fakeConn{},
+		WithLogger(nopLogger{}),
+		WithRecover(func(subject string, r interface{}) {
+			recovered = append(recovered, fmt.Sprintf("%s:%v", subject, r))
+		}))
+
+	handlers := []interface{}{
+		func(m *nats.Msg) { panic("msg") },
+		func(p *person) { panic("person") },
+		func(subject string, p *person) { panic("subject") },
+		func(subject, reply string, p *person) { panic("reply") },
+	}
+	for _, h := range handlers {
+		w, ok := s.handler("someservice.subaction", h).(func(*nats.Msg))
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.NotPanics(t, func() {
+			w(msg("someservice.subaction", "", &person{}))
+		})
+	}
+	assert.Equal(t, []string{
+		"someservice.subaction:msg",
+		"someservice.subaction:person",
+		"someservice.subaction:subject",
+		"someservice.subaction:reply",
+	}, recovered)
+}
+
+func TestHandlerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSubscriber(ctx, &fakeConn{})
+
+	var got []context.Context
+	f1 := s.handler("a", func(ctx context.Context, p *person) {
+		got = append(got, ctx)
+	}).(func(*nats.Msg))
+	f2 := s.handler("b", func(ctx context.Context, subject string, p *person) {
+		assert.Equal(t, "b", subject)
+		got = append(got, ctx)
+	}).(func(*nats.Msg))
+	f1(msg("a", "", &person{}))
+	f2(msg("b", "", &person{}))
+
+	cancel()
+	for _, c := range got {
+		_, ok := FromContext(c)
+		assert.True(t, ok)
+		assert.Error(t, c.Err())
+	}
+	assert.Len(t, got, 2)
+}
+
+type tenantKey struct{}
+
+func TestHandlerContextFunc(t *testing.T) {
+	withTenant := func(base context.Context, m *nats.Msg) context.Context {
+		return context.WithValue(base, tenantKey{}, m.Header.Get("X-Tenant"))
+	}
+	s := NewSubscriber(ctx, &fakeConn{}, WithContextFunc(withTenant))
+
+	var got []interface{}
+	for _, h := range []interface{}{
+		func(ctx context.Context, p *person) { got = append(got, ctx.Value(tenantKey{})) },
+		func(c *Context, p *person) { got = append(got, c.Context().Value(tenantKey{})) },
+	} {
+		m := msg("a", "", &person{})
+		m.Header = nats.Header{"X-Tenant": []string{"acme"}}
+		s.handler("a", h).(func(*nats.Msg))(m)
+	}
+	assert.Equal(t, []interface{}{"acme", "acme"}, got)
+}
+
+func TestHandlerArgs(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{})
+
+	var got []interface{}
+	for _, h := range []interface{}{
+		func(m *nats.Msg) { got = append(got, string(m.Data)) },
+		func(p *person) { got = append(got, *p) },
+		func(p person) { got = append(got, p) },
+		func(subject string, p *person) { got = append(got, subject, *p) },
+		func(subject, reply string, p *person) { got = append(got, subject, reply, *p) },
+		func(subject string, m *nats.Msg) { got = append(got, subject, string(m.Data)) },
+		func(m *nats.Msg, p *person) { got = append(got, m.Header.Get("X-Id"), *p) },
+		func(ctx context.Context, m *nats.Msg, p person) { got = append(got, m.Header.Get("X-Id"), p) },
+		func(c *Context, p *person) { got = append(got, c.Subject(), c.Reply(), c.Header().Get("X-Id"), *p) },
+	} {
+		m := msg("a", "r", &person{Name: "dc0d"})
+		m.Header = nats.Header{"X-Id": []string{"42"}}
+		s.handler("a", h).(func(*nats.Msg))(m)
+	}
+	p := person{Name: "dc0d"}
+	assert.Equal(t, []interface{}{
+		`{"name":"dc0d"}`,
+		p,
+		p,
+		"a", p,
+		"a", "r", p,
+		"a", `{"name":"dc0d"}`,
+		"42", p,
+		"42", p,
+		"a", "r", "42", p,
+	}, got)
+}
+
+func TestHandlerSubContext(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+
+	var errs []error
+	h := s.handler("a", func(c *Context, p *person) {
+		errs = append(errs, c.Publish("audit", p), c.Respond(p.Name))
+	}).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	h(msg("a", "", &person{Name: "dc0d"}))
+
+	assert.Equal(t, []error{nil, nil, nil, ErrNoReply}, errs)
+	assert.Equal(t, []interface{}{"dc0d"}, fc.published["r"])
+	assert.Len(t, fc.published["audit"], 2)
+}
+
+type result struct{}
+
+func TestCheckSignature(t *testing.T) {
+	for _, h := range []interface{}{
+		func(m *nats.Msg) {},
+		func(p *person) {},
+		func(subject string, p *person) {},
+		func(subject, reply string, p *person) {},
+		func(ctx context.Context, p *person) {},
+		func(ctx context.Context, subject, reply string, p *person) {},
+		func(m *nats.Msg, p *person) {},
+		func(ctx context.Context, m *nats.Msg, p *person) (*result, error) { return nil, nil },
+		func(c *Context, p *person) error { return nil },
+		func(p *person) error { return nil },
+		func(p *person) *result { return nil },
+		func(p *person) (*result, error) { return nil, nil },
+	} {
+		assert.NoError(t, checkSignature(h), "%T", h)
+	}
+	for _, h := range []interface{}{
+		nil,
+		"not a func",
+		func() {},
+		func(p *person, subject string) {},
+		func(subject string, p *person, reply string) {},
+		func(ctx context.Context) {},
+		func(a, b, c string, p *person) {},
+		func(ps ...*person) {},
+		func(p *person) (*result, *result) { return nil, nil },
+		func(p *person) (*result, *result, error) { return nil, nil, nil },
+	} {
+		assert.ErrorIs(t, checkSignature(h), ErrUnsupportedSignature, "%T", h)
+	}
+}
+
+func TestSupportedSignatures(t *testing.T) {
+	sigs := SupportedSignatures()
+	assert.Len(t, sigs, 48)
+	for _, sig := range sigs {
+		fn := reflect.MakeFunc(sig, func([]reflect.Value) []reflect.Value { return nil })
+		assert.True(t, IsSupported(fn.Interface()), "%v", sig)
+	}
+	assert.True(t, IsSupported(func(ctx context.Context, subject, reply string, p *person) (*result, error) { return nil, nil }))
+	assert.False(t, IsSupported(func(p *person, subject string) {}))
+	assert.False(t, IsSupported(nil))
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{}, WithHandlerTimeout(time.Millisecond*20))
+
+	var deadlines []time.Time
+	h := s.handler("a", func(ctx context.Context, p *person) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		deadlines = append(deadlines, deadline)
+		<-ctx.Done()
+		assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+	}).(func(*nats.Msg))
+	h(msg("a", "", &person{}))
+	h(msg("a", "", &person{}))
+	if assert.Len(t, deadlines, 2) {
+		assert.True(t, deadlines[1].After(deadlines[0]))
+	}
+	assert.NoError(t, ctx.Err())
+}
+
+func TestHandlerMaxConcurrency(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{}, WithMaxConcurrency(2))
+
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+		wg              sync.WaitGroup
+	)
+	release := make(chan struct{})
+	h := s.handler("a", func(p *person) {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}).(func(*nats.Msg))
+
+	wg.Add(5)
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i := 0; i < 5; i++ {
+			h(msg("a", "", &person{}))
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch did not block at the limit")
+	default:
+	}
+	close(release)
+	<-dispatched
+	wg.Wait()
+	assert.Equal(t, 2, maxRun)
+}
+
+func TestHandlerWorkerPool(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{}, WithWorkerPool(3))
+
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+		wg              sync.WaitGroup
+	)
+	release := make(chan struct{})
+	work := func(p *person) {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	a := s.handler("a", work).(func(*nats.Msg))
+	b := s.handler("b", work).(func(*nats.Msg))
+
+	wg.Add(8)
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i := 0; i < 4; i++ {
+			a(msg("a", "", &person{}))
+			b(msg("b", "", &person{}))
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch did not block at the pool size")
+	default:
+	}
+	mu.Lock()
+	assert.Equal(t, 3, running)
+	mu.Unlock()
+	close(release)
+	<-dispatched
+	wg.Wait()
+	assert.Equal(t, 3, maxRun)
+}
+
+type observation struct {
+	subject string
+	err     error
+}
+
+type recordMetrics []observation
+
+func (rm *recordMetrics) Observe(subject string, dur time.Duration, err error) {
+	*rm = append(*rm, observation{subject, err})
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	rm := &recordMetrics{}
+	s := NewSubscriber(ctx, &fakeConn{}, WithMetrics(rm), WithLogger(nopLogger{}))
+
+	failed := errors.New("failed")
+	h1 := s.handler("a", func(p *person) {}).(func(*nats.Msg))
+	h2 := s.handler("b", func(ctx context.Context, p *person) error { return failed }).(func(*nats.Msg))
+	h3 := s.handler("c", func(p *person) { panic("oops") }).(func(*nats.Msg))
+	h1(msg("a", "", &person{}))
+	h2(msg("b", "", &person{}))
+	h3(msg("c", "", &person{}))
+
+	if assert.Len(t, *rm, 3) {
+		assert.Equal(t, observation{"a", nil}, (*rm)[0])
+		assert.Equal(t, observation{"b", failed}, (*rm)[1])
+		assert.Equal(t, "c", (*rm)[2].subject)
+		assert.EqualError(t, (*rm)[2].err, "panic: oops")
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	type key struct{}
+	var trail []string
+	mw := func(name string) Middleware {
+		return func(next MsgHandler) MsgHandler {
+			return func(ctx context.Context, m *nats.Msg) error {
+				trail = append(trail, name)
+				return next(context.WithValue(ctx, key{}, name), m)
+			}
+		}
+	}
+	s := NewSubscriber(ctx, &fakeConn{}, WithMiddleware(mw("outer"), mw("inner")))
+	h := s.handler("a", func(ctx context.Context, m *nats.Msg) {
+		trail = append(trail, ctx.Value(key{}).(string)+" "+m.Header.Get("X-Id"))
+	}).(func(*nats.Msg))
+
+	m := msg("a", "", &person{})
+	m.Header = nats.Header{}
+	m.Header.Set("X-Id", "42")
+	h(m)
+	assert.Equal(t, []string{"outer", "inner", "inner 42"}, trail)
+}
+
+func TestHandlerDeadLetter(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithDeadLetter("dlq.{subject}"), WithLogger(nopLogger{}))
+	h := s.handler("someservice.subaction", func(p *person) error {
+		if p.Name == "" {
+			return errors.New("no name")
+		}
+		return nil
+	}).(func(*nats.Msg))
+
+	h(msg("someservice.subaction", "", &person{Name: "dc0d"}))
+	assert.Empty(t, fc.published)
+
+	m := msg("someservice.subaction", "", &person{})
+	h(m)
+	h(&nats.Msg{Subject: "someservice.subaction", Data: []byte("{")})
+	dls := fc.published["dlq.someservice.subaction"]
+	if !assert.Len(t, dls, 2) {
+		return
+	}
+	assert.Equal(t, &DeadLetter{Subject: "someservice.subaction", Error: "no name", Data: m.Data}, dls[0])
+	assert.Equal(t, []byte("{"), dls[1].(*DeadLetter).Data)
+}
+
+type envelope struct {
+	Code    string
+	Message string
+	Subject string
+}
+
+func TestHandlerErrorEncoder(t *testing.T) {
+	fc := &fakeConn{}
+	encode := func(err error) interface{} {
+		e := &envelope{Code: "failed", Message: err.Error()}
+		var me *MessageError
+		if errors.As(err, &me) {
+			e.Subject, e.Message = me.Subject, me.Err.Error()
+		}
+		return e
+	}
+	s := NewSubscriber(ctx, fc, WithDeadLetter("dlq.{subject}"), WithErrorEncoder(encode), WithLogger(nopLogger{}))
+	h := s.handler("a", func(p *person) error { return errors.New("no name") }).(func(*nats.Msg))
+	h(msg("a", "r", &person{}))
+
+	assert.Equal(t, []interface{}{&envelope{Code: "failed", Message: "no name"}}, fc.published["r"])
+	assert.Equal(t, []interface{}{&envelope{Code: "failed", Message: "no name", Subject: "a"}}, fc.published["dlq.a"])
+}
+
+func TestHandlerNilReply(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithErrorEncoder(func(error) interface{} { return nil }), WithLogger(nopLogger{}))
+	for subject, handler := range map[string]interface{}{
+		"ptr":     func(p *person) (*person, error) { return nil, nil },
+		"map":     func(p *person) map[string]int { return nil },
+		"slice":   func(p *person) []string { return nil },
+		"iface":   func(p *person) interface{} { return (*person)(nil) },
+		"encoded": func(p *person) (*person, error) { return p, errors.New("no name") },
+	} {
+		h := s.handler(subject, handler).(func(*nats.Msg))
+		h(msg(subject, "r."+subject, &person{Name: "dc0d"}))
+	}
+	assert.Empty(t, fc.published)
+}
+
+type timeoutConn struct{ fakeConn }
+
+func (tc *timeoutConn) FlushTimeout(time.Duration) error { return nats.ErrTimeout }
+
+func TestHandlerReplyTimeout(t *testing.T) {
+	var failed []error
+	logs := &recordLogger{}
+	s := NewSubscriber(ctx, &timeoutConn{}, WithReplyTimeout(time.Millisecond), WithLogger(logs),
+		WithErrorHandler(func(subject string, err error) { failed = append(failed, err) }))
+	h := s.handler("a", func(p *person) *person { return p }).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	if assert.Len(t, failed, 1) {
+		assert.ErrorIs(t, failed[0], nats.ErrTimeout)
+		assert.Contains(t, failed[0].Error(), `reply to "r"`)
+	}
+	for _, line := range logs.lines {
+		assert.NotContains(t, line, "reply")
+	}
+
+	logs = &recordLogger{}
+	s = NewSubscriber(ctx, &timeoutConn{}, WithReplyTimeout(time.Millisecond), WithLogger(logs))
+	h = s.handler("a", func(p *person) *person { return p }).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	if assert.Len(t, logs.lines, 1) {
+		assert.Contains(t, logs.lines[0], nats.ErrTimeout.Error())
+	}
+}
+
+func TestHandlerDeadlineHeader(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithDeadlineHeader("X-Deadline"), WithDeadLetter("dlq.{subject}"), WithLogger(nopLogger{}))
+	var deadlines []time.Time
+	h := s.handler("a", func(ctx context.Context, p *person) {
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, deadline)
+	}).(func(*nats.Msg))
+
+	valid := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for _, v := range []string{
+		valid.Format(time.RFC3339Nano),
+		strconv.FormatInt(valid.UnixMilli(), 10),
+		time.Now().Add(-time.Second).Format(time.RFC3339),
+		"",
+		"not a time",
+	} {
+		m := msg("a", "", &person{})
+		if v != "" {
+			m.Header = nats.Header{"X-Deadline": []string{v}}
+		}
+		h(m)
+	}
+
+	if assert.Len(t, deadlines, 4) {
+		assert.True(t, valid.Equal(deadlines[0]))
+		assert.True(t, valid.Equal(deadlines[1]))
+		assert.True(t, deadlines[2].IsZero())
+		assert.True(t, deadlines[3].IsZero())
+	}
+	dls := fc.published["dlq.a"]
+	if assert.Len(t, dls, 1) {
+		assert.Contains(t, dls[0].(*DeadLetter).Error, ErrExpired.Error())
+	}
+}
+
+func TestHandlerStats(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{}, WithLogger(nopLogger{}))
+	h := s.handler("a", func(p *person) error {
+		time.Sleep(time.Millisecond)
+		if p.Name == "" {
+			return errors.New("no name")
+		}
+		return nil
+	}).(func(*nats.Msg))
+	assert.Equal(t, SubStats{}, s.Stats()["a"])
+
+	start := time.Now()
+	h(msg("a", "", &person{Name: "dc0d"}))
+	h(msg("a", "", &person{}))
+	st := s.Stats()["a"]
+	assert.Equal(t, uint64(2), st.Received)
+	assert.Equal(t, uint64(1), st.Errors)
+	assert.False(t, st.LastMessage.Before(start))
+	assert.GreaterOrEqual(t, st.AvgLatency, time.Millisecond)
+	assert.NotContains(t, s.Stats(), "b")
+}
+
+func TestHandlerRetry(t *testing.T) {
+	fc := &fakeConn{}
+	var backoffs []int
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+	s := NewSubscriber(ctx, fc, WithRetry(3, backoff), WithDeadLetter("dlq.{subject}"), WithLogger(nopLogger{}))
+	calls := 0
+	h := s.handler("a", func(p *person) error {
+		calls++
+		if calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}).(func(*nats.Msg))
+	h(msg("a", "", &person{}))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []int{1, 2}, backoffs)
+	assert.Empty(t, fc.published)
+
+	calls = -10
+	h(msg("a", "", &person{}))
+	assert.Equal(t, -6, calls)
+	assert.Len(t, fc.published["dlq.a"], 1)
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s = NewSubscriber(cctx, fc, WithRetry(3, nil), WithLogger(nopLogger{}))
+	calls = 0
+	h = s.handler("b", func(p *person) error {
+		calls++
+		return errors.New("unavailable")
+	}).(func(*nats.Msg))
+	h(msg("b", "", &person{}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestHandlerRetryReply(t *testing.T) {
+	fc := &fakeConn{}
+	var decodeErrors int
+	s := NewSubscriber(ctx, fc, WithRetry(3, nil), WithLogger(nopLogger{}),
+		WithDecodeErrorHandler(func(string, []byte, error) { decodeErrors++ }))
+	calls := 0
+	h := s.handler("a", func(p *person) (*person, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("transient")
+		}
+		return p, nil
+	}).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []interface{}{&person{Name: "dc0d"}}, fc.published["r"])
+
+	calls = -10
+	h(msg("a", "r2", &person{}))
+	assert.Equal(t, -6, calls)
+	assert.Equal(t, []interface{}{&ErrorReply{Error: "transient"}}, fc.published["r2"])
+
+	calls = 0
+	h(&nats.Msg{Subject: "a", Reply: "r3", Data: []byte("{")})
+	assert.Equal(t, 0, calls)
+	assert.Equal(t, 1, decodeErrors)
+	assert.Empty(t, fc.published["r3"])
+}
+
+func TestHandlerValidator(t *testing.T) {
+	fc := &fakeConn{}
+	validator := func(subject string, payload interface{}) error {
+		if payload.(*person).Name == "" {
+			return errors.New("name is required")
+		}
+		return nil
+	}
+	s := NewSubscriber(ctx, fc, WithValidator(validator), WithDeadLetter("dlq.{subject}"), WithLogger(nopLogger{}))
+	var handled []string
+	h := s.handler("a", func(p *person) { handled = append(handled, p.Name) }).(func(*nats.Msg))
+	h(msg("a", "", &person{Name: "dc0d"}))
+	h(msg("a", "", &person{}))
+	assert.Equal(t, []string{"dc0d"}, handled)
+	if dls := fc.published["dlq.a"]; assert.Len(t, dls, 1) {
+		assert.Equal(t, "name is required", dls[0].(*DeadLetter).Error)
+	}
+}
+
+func TestHandlerStrictDecoding(t *testing.T) {
+	var failed []string
+	onError := func(subject string, err error) { failed = append(failed, subject) }
+	s := NewSubscriber(ctx, &fakeConn{}, WithStrictDecoding(), WithErrorHandler(onError), WithLogger(nopLogger{}))
+
+	var handled []string
+	h := s.handler("a", func(p *person) { handled = append(handled, p.Name) }).(func(*nats.Msg))
+	for _, data := range []string{
+		`{"name":"dc0d"}`,
+		`{"name":"dc0d","email":"x"}`,
+		`{"name":1}`,
+		`{"name":"dc0d"} {}`,
+	} {
+		h(&nats.Msg{Subject: "a", Data: []byte(data)})
+	}
+	assert.Equal(t, []string{"dc0d"}, handled)
+	assert.Equal(t, []string{"a", "a", "a"}, failed)
+
+	lax := NewSubscriber(ctx, &fakeConn{})
+	handled = nil
+	lax.handler("a", func(p *person) { handled = append(handled, p.Name) }).(func(*nats.Msg))(&nats.Msg{Subject: "a", Data: []byte(`{"name":"dc0d","email":"x"}`)})
+	assert.Equal(t, []string{"dc0d"}, handled)
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	fc := &fakeConn{}
+	var failed []error
+	onError := func(subject string, err error) { failed = append(failed, err) }
+	s := NewSubscriber(ctx, fc,
+		WithRateLimit("a", 1, 2),
+		WithHandlerTimeout(10*time.Millisecond),
+		WithDeadLetter("dlq.{subject}"),
+		WithErrorHandler(onError),
+		WithLogger(nopLogger{}))
+
+	var handled int
+	h := s.handler("a", func(p *person) { handled++ }).(func(*nats.Msg))
+	for i := 0; i < 3; i++ {
+		h(msg("a", "", &person{Name: "dc0d"}))
+	}
+	assert.Equal(t, 2, handled)
+	if assert.Len(t, failed, 1) {
+		assert.ErrorIs(t, failed[0], ErrRateLimited)
+	}
+	assert.Len(t, fc.published["dlq.a"], 1)
+
+	handled = 0
+	other := s.handler("b", func(p *person) { handled++ }).(func(*nats.Msg))
+	for i := 0; i < 3; i++ {
+		other(msg("b", "", &person{Name: "dc0d"}))
+	}
+	assert.Equal(t, 3, handled)
+}
+
+func TestHandlerPartitionKey(t *testing.T) {
+	byName := func(payload interface{}) string { return payload.(*person).Name }
+	s := NewSubscriber(ctx, &fakeConn{}, WithPartitionKey("a", byName))
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string][]uint)
+	)
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	h := s.handler("a", func(p *person) {
+		started <- p.Name
+		if p.Name == "slow" {
+			<-release
+		}
+		mu.Lock()
+		seen[p.Name] = append(seen[p.Name], p.Age)
+		mu.Unlock()
+	}).(func(*nats.Msg))
+
+	h(msg("a", "", &person{Name: "slow", Age: 1}))
+	h(msg("a", "", &person{Name: "slow", Age: 2}))
+	h(msg("a", "", &person{Name: "fast", Age: 1}))
+	h(msg("a", "", &person{Name: "fast", Age: 2}))
+
+	// the fast key is not held up by the slow one, which handles one message at a time
+	assert.ElementsMatch(t, []string{"slow", "fast", "fast"}, []string{<-started, <-started, <-started})
+	close(release)
+	idle, _ := s.inflight.stop()
+	<-idle
+	assert.Equal(t, map[string][]uint{"slow": {1, 2}, "fast": {1, 2}}, seen)
+}
+
+func TestDrainWithTimeoutCallbacks(t *testing.T) {
+	byName := func(payload interface{}) string { return payload.(*person).Name }
+	s := NewSubscriber(ctx, &fakeConn{}, WithMaxConcurrency(2), WithPartitionKey("b", byName), WithLogger(nopLogger{}))
+	started := make(chan string, 4)
+	release := make(chan struct{})
+	handler := func(p *person) {
+		started <- p.Name
+		<-release
+	}
+	a := s.handler("a", handler).(func(*nats.Msg))
+	b := s.handler("b", handler).(func(*nats.Msg))
+	a(msg("a", "", &person{Name: "slow"}))
+	assert.Equal(t, "slow", <-started)
+
+	err := s.DrainWithTimeout(time.Millisecond * 50)
+	assert.ErrorIs(t, err, ErrDrainTimeout)
+	assert.Contains(t, err.Error(), "1 callbacks still running")
+
+	a(msg("a", "", &person{Name: "late"}))
+	b(msg("b", "", &person{Name: "late"}))
+	close(release)
+	idle, _ := s.inflight.stop()
+	<-idle
+	assert.Empty(t, started, "handled after draining")
+}
+
+func TestHandlerDecodeErrorHandler(t *testing.T) {
+	var bad []string
+	onDecodeError := func(subject string, raw []byte, err error) {
+		assert.Error(t, err)
+		bad = append(bad, subject+" "+string(raw))
+	}
+	s := NewSubscriber(ctx, &fakeConn{}, WithDecodeErrorHandler(onDecodeError), WithLogger(nopLogger{}))
+
+	h := s.handler("a", func(p *person) error { return errors.New("failed") }).(func(*nats.Msg))
+	h(&nats.Msg{Subject: "a", Data: []byte("{")})
+	h(msg("a", "", &person{}))
+	assert.Equal(t, []string{"a {"}, bad)
+
+	typedHandler := typed(s, "b", func(p *person) {})
+	typedHandler(&nats.Msg{Subject: "b", Data: []byte("nope")})
+	assert.Equal(t, []string{"a {", "b nope"}, bad)
+}
+
+func TestHandlerDedup(t *testing.T) {
+	s := NewSubscriber(ctx, &fakeConn{}, WithDedup(time.Minute, ""), WithLogger(nopLogger{}))
+
+	var handled []string
+	fail := true
+	h := s.handler("a", func(m *nats.Msg, p *person) error {
+		handled = append(handled, m.Header.Get(nats.MsgIdHdr))
+		if fail && p.Name == "flaky" {
+			return errors.New("failed")
+		}
+		return nil
+	}).(func(*nats.Msg))
+	send := func(id, name string) {
+		m := msg("a", "", &person{Name: name})
+		if id != "" {
+			m.Header = nats.Header{nats.MsgIdHdr: []string{id}}
+		}
+		h(m)
+	}
+
+	send("1", "dc0d")
+	send("1", "dc0d")
+	send("", "dc0d")
+	send("", "dc0d")
+	send("2", "flaky")
+	fail = false
+	send("2", "flaky")
+	send("2", "flaky")
+	assert.Equal(t, []string{"1", "", "", "2", "2"}, handled)
+}
+
+func TestSeenIDs(t *testing.T) {
+	now := time.Now()
+	c := &seenIDs{window: time.Second, ids: make(map[string]time.Time)}
+	assert.True(t, c.add("a", now))
+	assert.False(t, c.add("a", now.Add(time.Millisecond)))
+	assert.True(t, c.add("a", now.Add(time.Second)))
+	assert.True(t, c.add("b", now.Add(3*time.Second)))
+	assert.Len(t, c.ids, 1)
+}
+
+type failingPublishConn struct{ fakeConn }
+
+func (*failingPublishConn) Publish(subject string, v interface{}) error {
+	return errors.New("no responders")
+}
+
+func TestHandlerReplyError(t *testing.T) {
+	var failed []error
+	onError := func(subject string, err error) {
+		assert.Equal(t, "a", subject)
+		failed = append(failed, err)
+	}
+	s := NewSubscriber(ctx, &failingPublishConn{}, WithErrorHandler(onError), WithLogger(nopLogger{}))
+	h := s.handler("a", func(p *person) *person { return p }).(func(*nats.Msg))
+	h(msg("a", "_INBOX.1", &person{Name: "dc0d"}))
+	h(msg("a", "", &person{Name: "dc0d"}))
+	if assert.Len(t, failed, 1) {
+		assert.EqualError(t, failed[0], `subly: reply to "_INBOX.1": no responders`)
+	}
+}
+
+func TestHandlerRespond(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc)
+
+	var errs []error
+	h := s.handler("a", func(ctx context.Context, p *person) {
+		if reply, ok := ReplySubject(ctx); ok {
+			assert.Equal(t, "r", reply)
+		}
+		errs = append(errs, Respond(ctx, p.Name))
+	}).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	h(msg("a", "", &person{Name: "dc0d"}))
+
+	assert.Equal(t, []error{nil, ErrNoReply}, errs)
+	assert.Equal(t, []interface{}{"dc0d"}, fc.published["r"])
+	assert.ErrorIs(t, Respond(context.Background(), "x"), ErrNoReply)
+}
+
+func TestHandlerReplyContext(t *testing.T) {
+	fc := &fakeConn{}
+	responder := func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, m *nats.Msg) error {
+			if reply, ok := ReplySubject(ctx); ok && reply == "r" {
+				assert.NoError(t, Respond(ctx, "accepted"))
+			}
+			return next(ctx, m)
+		}
+	}
+	s := NewSubscriber(ctx, fc, WithReplyContext(), WithMiddleware(responder))
+
+	var got []string
+	h := s.handler("a", func(p *person) string {
+		got = append(got, p.Name)
+		return "done"
+	}).(func(*nats.Msg))
+	h(msg("a", "r", &person{Name: "dc0d"}))
+	h(msg("a", "other", &person{Name: "dc0d"}))
+
+	assert.Equal(t, []string{"dc0d", "dc0d"}, got)
+	assert.Equal(t, []interface{}{"accepted"}, fc.published["r"])
+	assert.Equal(t, []interface{}{"done"}, fc.published["other"])
+}
+
+func TestHandlerAutoRequestID(t *testing.T) {
+	fc := &fakeConn{}
+	s := NewSubscriber(ctx, fc, WithAutoRequestID(""))
+
+	var ids []string
+	h := s.handler("a", func(ctx context.Context, m *nats.Msg, p *person) {
+		id, ok := RequestID(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, m.Header.Get(DefaultRequestIDHeader), id)
+		ids = append(ids, id)
+	}).(func(*nats.Msg))
+
+	m := msg("a", "", &person{})
+	m.Header = nats.Header{DefaultRequestIDHeader: []string{"req-1"}}
+	h(m)
+	h(msg("a", "", &person{}))
+	h(msg("a", "", &person{}))
+
+	if assert.Len(t, ids, 3) {
+		assert.Equal(t, "req-1", ids[0])
+		assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, ids[1])
+		assert.NotEqual(t, ids[1], ids[2])
+	}
+	_, ok := RequestID(context.Background())
+	assert.False(t, ok)
+}
+
+func TestHandlerAudit(t *testing.T) {
+	var audited []interface{}
+	audit := func(subject string, payload interface{}) { audited = append(audited, subject, payload) }
+
+	s := NewSubscriber(ctx, &fakeConn{}, WithAudit(1, audit))
+	var handled int
+	s.handler("a", func(p *person) { handled++ }).(func(*nats.Msg))(msg("a", "", &person{Name: "dc0d"}))
+	typed(s, "b", func(p *person) { handled++ })(msg("b", "", &person{Name: "b"}))
+	assert.Equal(t, 2, handled)
+	assert.Equal(t, []interface{}{"a", &person{Name: "dc0d"}, "b", &person{Name: "b"}}, audited)
+
+	audited = nil
+	s = NewSubscriber(ctx, &fakeConn{}, WithAudit(0, audit))
+	for i := 0; i < 10; i++ {
+		s.handler("a", func(p *person) {}).(func(*nats.Msg))(msg("a", "", &person{}))
+	}
+	assert.Empty(t, audited)
+}
@@ -0,0 +1,109 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// jsConn adapts a nats.JetStreamContext to Conn. Plain subscriptions bind
+// ephemeral push consumers and queue subscriptions bind durable queue consumers,
+// named after the queue, which subly creates if missing so they outlive unsubscribing. Messages get acknowledged by nats.go once the callback returns,
+// unless manual acks are enabled, see WithManualAck.
+type jsConn struct {
+	js        nats.JetStreamContext
+	enc       nats.Encoder
+	manualAck bool
+	opts      []nats.SubOpt
+}
+
+func (c *jsConn) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	return c.subscribe(subject, "", cb, nil)
+}
+
+func (c *jsConn) QueueSubscribe(subject, queue string, cb nats.Handler) (*nats.Subscription, error) {
+	return c.subscribe(subject, queue, cb, nil)
+}
+
+// subscribe binds cb to a consumer on subject, durable when queue is set, with
+// extra options applied after the configured ones.
+func (c *jsConn) subscribe(subject, queue string, cb nats.Handler, extra []nats.SubOpt) (*nats.Subscription, error) {
+	h, ok := cb.(func(*nats.Msg))
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedSignature, cb)
+	}
+	var opts []nats.SubOpt
+	if queue != "" {
+		stream, err := c.durable(subject, queue)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Bind(stream, queue))
+	}
+	if c.manualAck {
+		opts = append(opts, nats.ManualAck())
+	}
+	opts = append(append(opts, c.opts...), extra...)
+	if queue != "" {
+		return c.js.QueueSubscribe(subject, queue, h, opts...)
+	}
+	return c.js.Subscribe(subject, h, opts...)
+}
+
+// durable returns the stream of subject, creating the durable queue consumer named
+// queue on it unless it exists. nats.go deletes the consumers it creates itself
+// when their subscription is unsubscribed, but not those which it binds to.
+func (c *jsConn) durable(subject, queue string) (string, error) {
+	stream, err := c.js.StreamNameBySubject(subject)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.js.ConsumerInfo(stream, queue)
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return stream, err
+	}
+	_, err = c.js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        queue,
+		DeliverGroup:   queue,
+		DeliverSubject: nats.NewInbox(),
+		FilterSubject:  subject,
+		AckPolicy:      nats.AckExplicitPolicy,
+	})
+	if err != nil {
+		if _, ierr := c.js.ConsumerInfo(stream, queue); ierr == nil {
+			return stream, nil // created meanwhile, by another member of queue
+		}
+		return "", err
+	}
+	return stream, nil
+}
+
+func (c *jsConn) Publish(subject string, v interface{}) error {
+	data, err := c.enc.Encode(subject, v)
+	if err != nil {
+		return err
+	}
+	_, err = c.js.Publish(subject, data)
+	return err
+}
+
+// NewJetStreamSubscriber creates a Subscriber which binds the handlers to JetStream
+// consumers, for at-least-once delivery. Message methods get ephemeral consumers and
+// MessageQueue methods get durable queue consumers, named servicename_methodname,
+// as their queue. Messages are encoded as JSON.
+//
+// The reply subject of a JetStream message is used for acknowledging it, so the
+// values returned by handlers are not published. Durable consumers outlive the
+// Subscriber, so messages published meanwhile get delivered after a restart; subly
+// creates missing ones with the default configuration, so to configure one, like its
+// ack wait, create it ahead of time, as subscription options must agree with it.
+func NewJetStreamSubscriber(ctx context.Context, js nats.JetStreamContext, opts ...Option) *Subscriber {
+	c := &jsConn{js: js, enc: nats.EncoderForType(nats.JSON_ENCODER)}
+	s := NewSubscriber(ctx, c, opts...)
+	s.jetStream = true
+	c.manualAck = s.opts.manualAck
+	c.opts = s.opts.subOpts
+	return s
+}
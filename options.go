@@ -0,0 +1,900 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Logger is used by Subscriber to report errors that can not be returned,
+// like failing to unsubscribe on context cancelation. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the severity of what Subscriber logs.
+type LogLevel int
+
+// Log levels, from the least severe.
+const (
+	LogInfo  LogLevel = iota // notable events
+	LogWarn                  // likely mistakes, like methods which are skipped
+	LogError                 // failures, like failing to reply or to unsubscribe
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// LevelLogger is a Logger which gets the level of each entry too.
+// When the logger implements it, Logf is used instead of Printf.
+type LevelLogger interface {
+	Logger
+	Logf(level LogLevel, format string, v ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+
+type slogLogger struct{ l *slog.Logger }
+
+func (l slogLogger) Printf(format string, v ...interface{}) { l.l.Error(fmt.Sprintf(format, v...)) }
+
+func (l slogLogger) Logf(level LogLevel, format string, v ...interface{}) {
+	lv := slog.LevelError
+	switch level {
+	case LogInfo:
+		lv = slog.LevelInfo
+	case LogWarn:
+		lv = slog.LevelWarn
+	}
+	l.l.Log(context.Background(), lv, fmt.Sprintf(format, v...))
+}
+
+// Metrics gets notified of each callback invocation, with the subject, the time
+// spent in the handler and the error it returned, if any.
+type Metrics interface {
+	Observe(subject string, dur time.Duration, err error)
+}
+
+// NamingStyle is the way message names get derived from method names.
+type NamingStyle int
+
+// Naming styles, for a method named SubActionMessage.
+const (
+	NamingFlat   NamingStyle = iota // subaction, the default
+	NamingKebab                     // sub-action
+	NamingSnake                     // sub_action
+	NamingDotted                    // sub.action
+)
+
+// Option configures a Subscriber.
+type Option func(*options)
+
+type options struct {
+	logger         Logger
+	logLevel       LogLevel
+	silent         bool
+	prefix         string
+	prefixFunc     func(t reflect.Type) string
+	separator      string
+	queueSeparator string
+	drainOnCancel  bool
+	onPanic        func(subject string, r interface{})
+	messageSuffix  []string
+	queueSuffix    []string
+
+	strictSignatures     bool
+	declaringServiceName bool
+	flushAfterSubscribe  bool
+
+	resubscribeOnReconnect bool
+	handlerTimeout         time.Duration
+	maxConcurrency         int
+	workerPool             int
+	skip                   map[string]bool
+	metrics                Metrics
+	middlewares            []Middleware
+	deadLetter             string
+	subjectTemplate        string
+	err                    error // invalid configuration, see ErrInvalidTemplate
+	errorEncoder           func(error) interface{}
+	retries                int
+	backoff                func(attempt int) time.Duration
+	manualAck              bool
+	noDuplicates           bool
+	namingStyle            NamingStyle
+	serviceNameFunc        func(t reflect.Type) string
+	stripPrefixes          []string
+	autoUnsubscribe        int
+	pendingMsgs            int
+	pendingBytes           int
+	subOpts                []nats.SubOpt
+	errorHandler           func(subject string, err error)
+	correlationHeader      string
+	requestIDHeader        string
+	replyTimeout           time.Duration
+	replyContext           bool
+	validateSubjects       bool
+	validator              func(subject string, payload interface{}) error
+	wildcardMarker         string
+	warnNearMisses         bool
+	errorOnNoMethods       bool
+	manualTeardown         bool
+	requireConnected       bool
+	forceQueue             map[string]string // method name or subject -> queue name
+	forcePlain             map[string]bool   // method names or subjects
+	nameTake               int
+	nameDrop               int
+	strictDecoding         bool
+	decodeErrorHandler     func(subject string, raw []byte, err error)
+	auditRate              float64
+	auditFunc              func(subject string, payload interface{})
+	dedupWindow            time.Duration
+	dedupHeader            string
+	deadlineHeader         string
+	rateLimits             map[string]rateLimit
+	partitionKeys          map[string]func(payload interface{}) string
+	contextFunc            func(base context.Context, m *nats.Msg) context.Context
+
+	methodCache sync.Map // reflect.Type -> []methodInfo
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		logger:         stdLogger{},
+		separator:      ".",
+		queueSeparator: "_",
+		messageSuffix:  []string{"Message"},
+		queueSuffix:    []string{"MessageQueue"},
+		nameTake:       1,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithLogger sets the logger used for reporting internal errors,
+// default is the standard log package.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithSlog sets a structured logger for reporting internal errors,
+// which get logged at their level.
+func WithSlog(logger *slog.Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = slogLogger{logger}
+		}
+	}
+}
+
+// WithLogLevel makes the Subscriber log only entries at level or above, default is LogInfo.
+func WithLogLevel(level LogLevel) Option {
+	return func(o *options) { o.logLevel = level }
+}
+
+// WithSilent turns off internal logging. Errors which can be returned still are.
+func WithSilent() Option {
+	return func(o *options) { o.silent = true }
+}
+
+// logf logs to the logger, unless silent or below the log level.
+func (o *options) logf(level LogLevel, format string, v ...interface{}) {
+	if o.silent || level < o.logLevel {
+		return
+	}
+	if l, ok := o.logger.(LevelLogger); ok {
+		l.Logf(level, format, v...)
+		return
+	}
+	o.logger.Printf(format, v...)
+}
+
+// WithSubjectPrefix prepends prefix (joined by the separator) to every subject,
+// both the ones derived by Subscribe and the ones provided to SubscribeFunc.
+func WithSubjectPrefix(prefix string) Option {
+	return func(o *options) { o.prefix = prefix }
+}
+
+// WithPrefixFunc sets a func computing the subject prefix from the type of each service,
+// for services of different domains, like billing and shipping, to share a Subscriber.
+// It replaces WithSubjectPrefix for the subjects derived by Subscribe, and an empty
+// result means no prefix; subjects provided to SubscribeFunc keep the static prefix.
+// A Publisher using it needs service values, see Publisher.Subject.
+func WithPrefixFunc(fn func(t reflect.Type) string) Option {
+	return func(o *options) { o.prefixFunc = fn }
+}
+
+// ErrInvalidTemplate is returned, when subscribing or publishing, for a subject
+// template with unknown or unclosed placeholders, see WithSubjectTemplate.
+var ErrInvalidTemplate = errors.New("subly: invalid subject template")
+
+// WithSubjectTemplate sets the layout of the subjects derived by Subscribe, where
+// {service} and {message} get replaced by the service and message names, as in
+// "events.{service}.v1.{message}". The subject prefix, if any, still gets prepended,
+// and subjects provided as is, like by SubjectOverrider, are not affected.
+// Other placeholders make NewSubscriber log, and subscribing fail, with ErrInvalidTemplate.
+func WithSubjectTemplate(tmpl string) Option {
+	return func(o *options) {
+		if err := checkTemplate(tmpl); err != nil {
+			o.err = errors.Join(o.err, err)
+			return
+		}
+		o.subjectTemplate = tmpl
+	}
+}
+
+func checkTemplate(tmpl string) error {
+	rest := tmpl
+	for {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return fmt.Errorf("%w: %q has an unclosed placeholder", ErrInvalidTemplate, tmpl)
+		}
+		switch name := rest[i+1 : i+j]; name {
+		case "service", "message":
+		default:
+			return fmt.Errorf("%w: %q has unknown placeholder {%s}", ErrInvalidTemplate, tmpl, name)
+		}
+		rest = rest[i+j+1:]
+	}
+	if !strings.Contains(tmpl, "{message}") {
+		return fmt.Errorf("%w: %q has no {message}", ErrInvalidTemplate, tmpl)
+	}
+	return nil
+}
+
+// WithSkip keeps the methods named methods, like FormatMessage, from getting subscribed
+// although their names end in a handler suffix, for services of any type.
+// A service can also implement MessageSkipper for its own methods.
+func WithSkip(methods ...string) Option {
+	return func(o *options) {
+		if o.skip == nil {
+			o.skip = make(map[string]bool)
+		}
+		for _, m := range methods {
+			o.skip[m] = true
+		}
+	}
+}
+
+// WithSeparator sets the string used for joining subject parts, default is a dot.
+func WithSeparator(separator string) Option {
+	return func(o *options) { o.separator = separator }
+}
+
+// WithQueueSeparator sets the string used for joining queue name parts,
+// default is an underscore.
+func WithQueueSeparator(separator string) Option {
+	return func(o *options) { o.queueSeparator = separator }
+}
+
+// WithDrainOnCancel makes subscriptions drain, instead of unsubscribe, when
+// context got canceled, so messages already delivered to the client get processed.
+func WithDrainOnCancel() Option {
+	return func(o *options) { o.drainOnCancel = true }
+}
+
+// WithRecover sets a handler which gets called with the subject and the recovered
+// value when a callback panics. Panics are always recovered and logged.
+func WithRecover(handler func(subject string, r interface{})) Option {
+	return func(o *options) { o.onPanic = handler }
+}
+
+// WithMessageSuffix sets the method name suffixes which mark a method as a
+// plain subscriber, default is Message.
+func WithMessageSuffix(suffix ...string) Option {
+	return func(o *options) { o.messageSuffix = suffix }
+}
+
+// WithQueueSuffix sets the method name suffixes which mark a method as a
+// queue subscriber, default is MessageQueue. Queue suffixes are checked
+// before message suffixes.
+func WithQueueSuffix(suffix ...string) Option {
+	return func(o *options) { o.queueSuffix = suffix }
+}
+
+// WithStrictSignatures makes Subscribe and SubscribeFunc fail for handlers with
+// unsupported signatures, or payload types which can not get decoded from JSON,
+// instead of logging and attempting to subscribe them.
+func WithStrictSignatures() Option {
+	return func(o *options) { o.strictSignatures = true }
+}
+
+// WithDeclaringServiceName derives the service name from the type which declares
+// a method, instead of the type passed to Subscribe. This only makes a difference
+// for methods promoted from embedded fields.
+func WithDeclaringServiceName() Option {
+	return func(o *options) { o.declaringServiceName = true }
+}
+
+// WithFlushAfterSubscribe makes every subscribe method, like Subscribe, SubscribeFunc,
+// SubscribeTyped and SubscribeChan, flush the connection once its handlers are registered,
+// see Subscriber.Flush.
+func WithFlushAfterSubscribe() Option {
+	return func(o *options) { o.flushAfterSubscribe = true }
+}
+
+// WithResubscribeOnReconnect makes the Subscriber recreate, after the connection
+// got reconnected, the subscriptions it tracks which are no longer valid. Those closed,
+// like by reaching their max or getting unsubscribed through their handle, are no
+// longer tracked and do not get recreated. The reconnect handler already set on the connection keeps getting called.
+func WithResubscribeOnReconnect() Option {
+	return func(o *options) { o.resubscribeOnReconnect = true }
+}
+
+// WithHandlerTimeout sets a deadline for each invocation of context-aware handlers.
+// The handler is not interrupted; its context gets canceled for cooperative cancellation.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(o *options) { o.handlerTimeout = d }
+}
+
+// WithMaxConcurrency makes callbacks run concurrently, with at most n invocations
+// per subscription at once. Messages beyond the limit block the dispatch of their
+// subscription until a slot frees. Message ordering is not preserved.
+func WithMaxConcurrency(n int) Option {
+	return func(o *options) { o.maxConcurrency = n }
+}
+
+// WithWorkerPool makes callbacks run concurrently, off the dispatch of their subscription,
+// with at most size invocations at once across all the subscriptions of the Subscriber.
+// Messages beyond the limit block the dispatch of their subscription until a worker frees,
+// and WithMaxConcurrency still bounds each subscription. Message ordering is not preserved,
+// except per key with WithPartitionKey.
+func WithWorkerPool(size int) Option {
+	return func(o *options) { o.workerPool = size }
+}
+
+// WithMetrics sets the Metrics which observe every callback invocation,
+// default is none.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) { o.metrics = m }
+}
+
+// WithMiddleware adds middlewares which wrap the handling of each message,
+// the first one being the outermost.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(o *options) { o.middlewares = append(o.middlewares, mw...) }
+}
+
+// WithDeadLetter makes failed messages get published, as a DeadLetter, to a subject
+// computed from subjectTemplate, where {subject} is replaced by the subject the message
+// was received on. For example "dlq.{subject}" routes the failures of
+// someservice.subaction to dlq.someservice.subaction.
+func WithDeadLetter(subjectTemplate string) Option {
+	return func(o *options) { o.deadLetter = subjectTemplate }
+}
+
+// WithErrorEncoder sets the payload published for errors, in place of an ErrorReply when
+// a handler returns an error for a message with a reply subject, and of a DeadLetter,
+// in which case fn gets a *MessageError. The payload gets encoded with the encoder of
+// the connection, so errors can follow the envelope and wire format of other messages.
+func WithErrorEncoder(fn func(error) interface{}) Option {
+	return func(o *options) { o.errorEncoder = fn }
+}
+
+// WithRetry makes handlers which fail get invoked again, up to attempts times,
+// waiting backoff(attempt) before each retry, attempt starting at 1. Retrying stops
+// when the context of the Subscriber gets canceled. Once retries are exhausted,
+// the message goes to the dead-letter subject, if one is set. Only the handler gets
+// invoked again: messages which fail to decode or validate are not retried, and
+// the reply, if any, carries the result of the last attempt.
+func WithRetry(attempts int, backoff func(attempt int) time.Duration) Option {
+	return func(o *options) {
+		o.retries = attempts
+		o.backoff = backoff
+	}
+}
+
+// WithManualAck makes JetStream subscribers, see NewJetStreamSubscriber, acknowledge
+// messages only once handled. Handlers which take the *nats.Msg acknowledge it themselves,
+// by calling m.Ack or m.Nak. For the other handlers, subly acknowledges the message
+// when the handler returns a nil error and negatively acknowledges it otherwise,
+// for redelivery. It has no effect on core NATS subscribers.
+func WithManualAck() Option {
+	return func(o *options) { o.manualAck = true }
+}
+
+// WithNoDuplicates makes subscribing fail when a subject is already bound by
+// this Subscriber, for example when two methods derive the same subject.
+// The error names both handlers.
+func WithNoDuplicates() Option {
+	return func(o *options) { o.noDuplicates = true }
+}
+
+// WithNamingStyle sets the way message names get derived from method names,
+// splitting them on camelCase boundaries, default is NamingFlat.
+func WithNamingStyle(style NamingStyle) Option {
+	return func(o *options) { o.namingStyle = style }
+}
+
+// WithServiceName sets the func deriving the service part of subjects from the type
+// of the service, which gets used as is. Default is the lowercased type name, without its package.
+// Services implementing NamedService keep their own name.
+func WithServiceName(fn func(t reflect.Type) string) Option {
+	return func(o *options) { o.serviceNameFunc = fn }
+}
+
+// serviceName derives the service name from t, the type of the service.
+func (o *options) serviceName(t reflect.Type) string {
+	if o.serviceNameFunc != nil {
+		return o.serviceNameFunc(t)
+	}
+	return strings.ToLower(polishKindName(t.String(), o.nameTake, o.nameDrop))
+}
+
+// WithNameTake sets how many of the trailing dot separated segments of the
+// package-qualified type name, like subly.someService, make the service name,
+// default is 1. With 2, the package name is included, as in subly.someservice.
+// Only the last element of the package path is part of the type name, and
+// the segments are joined by a dot, regardless of WithSeparator. At least one
+// segment is always taken, so n below 1 acts as 1.
+func WithNameTake(n int) Option {
+	return func(o *options) { o.nameTake = n }
+}
+
+// WithNameDrop sets how many trailing segments get dropped from the segments
+// taken by WithNameTake, default is 0. At least one segment is always kept.
+func WithNameDrop(n int) Option {
+	return func(o *options) { o.nameDrop = n }
+}
+
+// WithStripPrefixes sets prefixes, like Handle or On, which get stripped from method
+// names before deriving message names. The first matching prefix is stripped when it is
+// followed by an upper case letter, so OnlineMessage keeps its name.
+func WithStripPrefixes(prefixes ...string) Option {
+	return func(o *options) { o.stripPrefixes = prefixes }
+}
+
+// WithAutoUnsubscribe makes all subscriptions unsubscribe automatically after
+// n messages, counted from zero again when recreated, see SubscribeN.
+func WithAutoUnsubscribe(n int) Option {
+	return func(o *options) { o.autoUnsubscribe = n }
+}
+
+// WithPendingLimits sets the limits of pending messages and bytes for every
+// subscription, beyond which messages get dropped as for a slow consumer.
+// Zero keeps the default of nats.go for that limit and -1 makes it unlimited.
+// Channel subscriptions, see SubscribeChan, are bounded by their channel instead.
+func WithPendingLimits(msgs, bytes int) Option {
+	return func(o *options) {
+		o.pendingMsgs = msgs
+		o.pendingBytes = bytes
+	}
+}
+
+// WithSubOpts sets options passed to every JetStream subscription,
+// see NewJetStreamSubscriber. Other Subscribers ignore them, and log a warning.
+func WithSubOpts(opts ...nats.SubOpt) Option {
+	return func(o *options) { o.subOpts = append(o.subOpts, opts...) }
+}
+
+// WithErrorHandler sets a func which gets the asynchronous errors of the subscriptions
+// made by the Subscriber, like nats.ErrSlowConsumer when messages get dropped, along with
+// their subject. It needs the underlying *nats.Conn, and keeps its current error handler.
+// It gets the replies which fail to publish too, along with the subject of their request,
+// instead of them getting logged.
+func WithErrorHandler(fn func(subject string, err error)) Option {
+	return func(o *options) { o.errorHandler = fn }
+}
+
+// WithStrictDecoding makes JSON payloads with unknown fields, mismatched types or trailing
+// data fail to decode, instead of reaching handlers as zero or partial values.
+// Such failures are passed to the error handler too, if one is set.
+func WithStrictDecoding() Option {
+	return func(o *options) { o.strictDecoding = true }
+}
+
+// WithDecodeErrorHandler sets a func which gets the messages which fail to decode
+// into the payload of their handler, along with their subject and the error,
+// apart from the errors returned by handlers.
+func WithDecodeErrorHandler(fn func(subject string, raw []byte, err error)) Option {
+	return func(o *options) { o.decodeErrorHandler = fn }
+}
+
+// WithDedup skips the messages whose ID, read from header idHeader, was already handled
+// successfully, or is being handled, on the same subject within window. Duplicates do not
+// reach the handler, nor the middlewares and metrics, and get acknowledged with manual acks.
+// Default idHeader is nats.MsgIdHdr, the JetStream deduplication header.
+func WithDedup(window time.Duration, idHeader string) Option {
+	return func(o *options) {
+		if idHeader == "" {
+			idHeader = nats.MsgIdHdr
+		}
+		o.dedupWindow = window
+		o.dedupHeader = idHeader
+	}
+}
+
+// WithDeadlineHeader makes messages carrying a deadline in the header name, as an RFC 3339
+// timestamp or a Unix time in milliseconds, get dropped with ErrExpired once it passed,
+// without invoking their handler. Like other failures, they get observed by the metrics
+// and dead-lettered, if configured, and with manual acks they get terminated instead of
+// redelivered. The deadline bounds the context of the messages still valid.
+func WithDeadlineHeader(name string) Option {
+	return func(o *options) { o.deadlineHeader = name }
+}
+
+// WithAudit passes a sample of the decoded payloads, a sampleRate fraction of them
+// between 0 and 1, to fn before their handlers run, for inspecting the traffic.
+// Handlers taking the raw message pass the *nats.Msg as the payload.
+func WithAudit(sampleRate float64, fn func(subject string, payload interface{})) Option {
+	return func(o *options) {
+		o.auditRate = sampleRate
+		o.auditFunc = fn
+	}
+}
+
+type rateLimit struct {
+	rps   float64
+	burst int
+}
+
+// WithRateLimit limits the messages handled per second on subject to rps, allowing bursts
+// of up to burst messages. Messages beyond the rate wait for their turn; those which would
+// wait longer than the handler timeout, if one is set, are dropped with ErrRateLimited and
+// passed to the error handler and the dead-letter subject, if set.
+// An empty subject sets the limit of the subjects without one of their own.
+func WithRateLimit(subject string, rps float64, burst int) Option {
+	return func(o *options) {
+		if o.rateLimits == nil {
+			o.rateLimits = make(map[string]rateLimit)
+		}
+		o.rateLimits[subject] = rateLimit{rps: rps, burst: burst}
+	}
+}
+
+// rateLimit returns the rate limit of subject, if any.
+func (o *options) rateLimit(subject string) (rateLimit, bool) {
+	if l, ok := o.rateLimits[subject]; ok {
+		return l, true
+	}
+	l, ok := o.rateLimits[""]
+	return l, ok
+}
+
+// WithContextFunc sets a func deriving the context of each message from the context of
+// the Subscriber, for example to carry values read from its headers, like a tenant ID.
+// It applies to the handlers taking a context.Context or a *Context, before the handler timeout.
+func WithContextFunc(fn func(base context.Context, m *nats.Msg) context.Context) Option {
+	return func(o *options) { o.contextFunc = fn }
+}
+
+// WithPartitionKey makes the messages on subject with the same key, as returned by keyFn
+// for their decoded payload, get handled in order, one at a time, while messages with
+// different keys get handled concurrently. Payloads get decoded once more to get their key,
+// and messages which fail to decode share the empty key.
+func WithPartitionKey(subject string, keyFn func(payload interface{}) string) Option {
+	return func(o *options) {
+		if o.partitionKeys == nil {
+			o.partitionKeys = make(map[string]func(payload interface{}) string)
+		}
+		o.partitionKeys[subject] = keyFn
+	}
+}
+
+// WithReplyTimeout bounds how long publishing a reply may take, including the flush
+// which makes sure the server got it, so each reply costs a round trip to the server
+// (a PING/PONG). It needs a connection which can flush, like *nats.EncodedConn.
+// Replies which fail, or time out, are passed to the error handler if set, and
+// logged otherwise.
+func WithReplyTimeout(d time.Duration) Option {
+	return func(o *options) { o.replyTimeout = d }
+}
+
+// WithReplyContext makes every message get handled with its *Context in the context,
+// whatever the signature of the handler, so middlewares can use ReplySubject and Respond
+// for handlers like func(p *person), which do not see the reply subject.
+// A value returned by the handler is still published as a reply, unless Respond
+// was called before the handler returned.
+func WithReplyContext() Option {
+	return func(o *options) { o.replyContext = true }
+}
+
+// DefaultCorrelationHeader is the header used by WithCorrelationHeader, when no name is provided.
+const DefaultCorrelationHeader = "X-Correlation-ID"
+
+// WithCorrelationHeader makes replies carry the header name of the message they reply to,
+// default is DefaultCorrelationHeader. It needs the underlying *nats.Conn, for publishing headers.
+func WithCorrelationHeader(name string) Option {
+	return func(o *options) {
+		if name == "" {
+			name = DefaultCorrelationHeader
+		}
+		o.correlationHeader = name
+	}
+}
+
+// DefaultRequestIDHeader is the header used by WithAutoRequestID, when no name is provided.
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// WithAutoRequestID makes every message get handled with the request ID in its header
+// name, default is DefaultRequestIDHeader, in the context, see RequestID. Messages
+// without one get a random UUID, set on their header too, before the middlewares run.
+// Replies carry it when name is also the header set by WithCorrelationHeader.
+func WithAutoRequestID(name string) Option {
+	return func(o *options) {
+		if name == "" {
+			name = DefaultRequestIDHeader
+		}
+		o.requestIDHeader = name
+	}
+}
+
+// WithSubjectValidation makes subscribing fail with ErrInvalidSubject, before calling NATS,
+// for subjects which are not valid NATS subjects, naming the method and the subject.
+func WithSubjectValidation() Option {
+	return func(o *options) { o.validateSubjects = true }
+}
+
+// WithValidator sets a func which validates each decoded payload before the handler
+// gets called. When it returns an error, the handler is skipped and the message is
+// treated as failed, going to the dead-letter subject if one is set. Handlers taking
+// the raw *nats.Msg are not validated.
+func WithValidator(fn func(subject string, payload interface{}) error) Option {
+	return func(o *options) { o.validator = fn }
+}
+
+// WithWildcardMarker sets a marker, like All, which makes methods ending in it,
+// before the suffix, bind a wildcard subject: FooAllMessage gets someservice.foo.>
+// instead of someservice.fooall. Such handlers should take the subject, as in
+// func(subject string, o *obj), to know which subject a message arrived on.
+// Default is none.
+func WithWildcardMarker(marker string) Option {
+	return func(o *options) { o.wildcardMarker = marker }
+}
+
+// WithWarnNearMisses makes Subscribe log the exported methods which are not handlers,
+// but whose names almost end in a recognized suffix, as probable typos, like SubActionMesage.
+// Methods excluded by WithSkip or MessageSkipper are not reported.
+func WithWarnNearMisses() Option {
+	return func(o *options) { o.warnNearMisses = true }
+}
+
+// WithRequireConnected makes subscribing fail with ErrNotConnected while the connection
+// is not connected, like when closed or reconnecting, instead of buffering the subscriptions.
+// It needs the underlying *nats.Conn.
+func WithRequireConnected() Option {
+	return func(o *options) { o.requireConnected = true }
+}
+
+// WithForceQueue makes the handler method named methodOrSubject, or bound to that subject,
+// a queue subscription in queueName, regardless of its suffix. An empty queueName keeps
+// the queue name derived by the naming convention.
+// A method name applies to the methods of that name of all services, and a subject
+// takes precedence over a method name.
+func WithForceQueue(methodOrSubject string, queueName string) Option {
+	return func(o *options) {
+		if o.forceQueue == nil {
+			o.forceQueue = make(map[string]string)
+		}
+		o.forceQueue[methodOrSubject] = queueName
+		delete(o.forcePlain, methodOrSubject)
+	}
+}
+
+// WithForcePlain makes the handler methods named methodsOrSubjects, or bound to those
+// subjects, plain subscriptions, regardless of their suffixes, see WithForceQueue.
+func WithForcePlain(methodsOrSubjects ...string) Option {
+	return func(o *options) {
+		if o.forcePlain == nil {
+			o.forcePlain = make(map[string]bool)
+		}
+		for _, v := range methodsOrSubjects {
+			o.forcePlain[v] = true
+			delete(o.forceQueue, v)
+		}
+	}
+}
+
+// forceDelivery applies WithForceQueue and WithForcePlain to v, those given
+// the subject of v taking precedence over those given its method name.
+func (o *options) forceDelivery(v *serviceMessage) {
+	if len(o.forceQueue) == 0 && len(o.forcePlain) == 0 {
+		return
+	}
+	for _, key := range []string{o.subject(*v), v.methodName} {
+		if o.forcePlain[key] {
+			v.queue = false
+			v.queueName = ""
+			v.queueGroups = nil
+			return
+		}
+		if queue, ok := o.forceQueue[key]; ok {
+			v.queue = true
+			if queue != "" {
+				v.queueName = queue
+				v.queueGroups = nil
+			}
+			return
+		}
+	}
+}
+
+// WithManualTeardown makes subscriptions not get unsubscribed when context got canceled,
+// leaving it to Close, DrainWithTimeout or Unsubscribe. No goroutine waits on the context then.
+func WithManualTeardown() Option {
+	return func(o *options) { o.manualTeardown = true }
+}
+
+// WithErrorOnNoMethods makes Subscribe return ErrNoMethods for services without any
+// handler methods, which usually means a wrong value got passed or its methods are
+// not exported. Skipped methods do not count. By default such services are silently skipped.
+func WithErrorOnNoMethods() Option {
+	return func(o *options) { o.errorOnNoMethods = true }
+}
+
+// wildcard reports whether name, the method name without its suffix, has the
+// wildcard marker, and returns name without it.
+func (o *options) wildcard(name string) (string, bool) {
+	marker := o.wildcardMarker
+	if marker == "" || len(name) <= len(marker) || !strings.HasSuffix(name, marker) {
+		return name, false
+	}
+	return strings.TrimSuffix(name, marker), true
+}
+
+// messageName derives the message name from name, the method name without its suffix.
+func (o *options) messageName(name string) string {
+	for _, prefix := range o.stripPrefixes {
+		if prefix != "" && len(name) > len(prefix) && strings.HasPrefix(name, prefix) && isUpper(name[len(prefix)]) {
+			name = strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+	var sep string
+	switch o.namingStyle {
+	case NamingKebab:
+		sep = "-"
+	case NamingSnake:
+		sep = "_"
+	case NamingDotted:
+		sep = "."
+	default:
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(strings.Join(splitWords(name), sep))
+}
+
+// splitWords splits name on camelCase boundaries, before an upper case letter
+// which follows a lower case letter or a digit. Consecutive upper case letters
+// make one word, an acronym, which ends before the last one when a lower case
+// letter follows, as in URL|Parser.
+func splitWords(name string) []string {
+	var (
+		words []string
+		start int
+	)
+	for i := 1; i < len(name); i++ {
+		prev, c := name[i-1], name[i]
+		acronymEnd := isUpper(prev) && i+1 < len(name) && isLower(name[i+1])
+		if isUpper(c) && (isLower(prev) || isDigit(prev) || acronymEnd) {
+			words = append(words, name[start:i])
+			start = i
+		}
+	}
+	return append(words, name[start:])
+}
+
+func isUpper(c byte) bool { return 'A' <= c && c <= 'Z' }
+func isLower(c byte) bool { return 'a' <= c && c <= 'z' }
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// classify reports whether methodName is a handler, if it should be
+// queue subscribed and the method name with the suffix removed.
+func (o *options) classify(methodName string) (name string, isHandler, queue bool) {
+	for _, suffix := range o.queueSuffix {
+		if suffix != "" && strings.HasSuffix(methodName, suffix) {
+			return strings.TrimSuffix(methodName, suffix), true, true
+		}
+	}
+	for _, suffix := range o.messageSuffix {
+		if suffix != "" && strings.HasSuffix(methodName, suffix) {
+			return strings.TrimSuffix(methodName, suffix), true, false
+		}
+	}
+	return methodName, false, false
+}
+
+// namedMessage derives the message of method for the service named serviceName,
+// reporting whether method has a handler suffix.
+func (o *options) namedMessage(serviceName, method string) (serviceMessage, bool) {
+	messageName, isHandler, isQueue := o.classify(method)
+	messageName, wildcard := o.wildcard(messageName)
+	return serviceMessage{
+		serviceName: serviceName,
+		messageName: o.messageName(messageName),
+		methodName:  method,
+		queue:       isQueue,
+		wildcard:    wildcard,
+	}, isHandler
+}
+
+func (o *options) subject(v serviceMessage) string {
+	if v.subject != "" {
+		return v.subject
+	}
+	prefix := o.prefix
+	if v.ownPrefix {
+		prefix = v.prefix
+	}
+	if o.subjectTemplate != "" {
+		return o.templated(prefix, v)
+	}
+	n := len(v.serviceName) + len(o.separator) + len(v.messageName)
+	if prefix != "" {
+		n += len(prefix) + len(o.separator)
+	}
+	if v.wildcard {
+		n += len(o.separator) + 1
+	}
+	var sb strings.Builder
+	sb.Grow(n)
+	if prefix != "" {
+		sb.WriteString(prefix)
+		sb.WriteString(o.separator)
+	}
+	sb.WriteString(v.serviceName)
+	sb.WriteString(o.separator)
+	sb.WriteString(v.messageName)
+	if v.wildcard {
+		sb.WriteString(o.separator)
+		sb.WriteByte('>')
+	}
+	return sb.String()
+}
+
+// templated builds the subject of v from the subject template.
+func (o *options) templated(prefix string, v serviceMessage) string {
+	subject := strings.NewReplacer("{service}", v.serviceName, "{message}", v.messageName).Replace(o.subjectTemplate)
+	if prefix != "" {
+		subject = prefix + o.separator + subject
+	}
+	if v.wildcard {
+		subject += o.separator + ">"
+	}
+	return subject
+}
+
+// prefixed prepends the configured prefix, if any, to subject.
+func (o *options) prefixed(subject string) string {
+	if o.prefix == "" {
+		return subject
+	}
+	return o.prefix + o.separator + subject
+}
+
+func (o *options) queueName(v serviceMessage) string {
+	if v.queueName != "" {
+		return v.queueName
+	}
+	return v.serviceName + o.queueSeparator + v.messageName
+}
@@ -0,0 +1,182 @@
+package subly
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsSubject(t *testing.T) {
+	v := serviceMessage{serviceName: "someservice", messageName: "subaction"}
+	for _, c := range []struct {
+		opts    []Option
+		subject string
+	}{
+		{nil, "someservice.subaction"},
+		{[]Option{WithSubjectPrefix("tenantA")}, "tenantA.someservice.subaction"},
+		{[]Option{WithSeparator(":")}, "someservice:subaction"},
+		{[]Option{WithSubjectPrefix("tenantA"), WithSeparator(":")}, "tenantA:someservice:subaction"},
+		{[]Option{WithSubjectTemplate("events.{service}.v1.{message}")}, "events.someservice.v1.subaction"},
+		{[]Option{WithSubjectPrefix("tenantA"), WithSubjectTemplate("{message}.{service}")}, "tenantA.subaction.someservice"},
+	} {
+		o := newOptions(c.opts...)
+		assert.Equal(t, c.subject, o.subject(v))
+	}
+}
+
+func TestOptionsSubjectTemplate(t *testing.T) {
+	for _, tmpl := range []string{"events.{service}.{version}.{message}", "events.{service", "events.{service}"} {
+		o := newOptions(WithSubjectTemplate(tmpl))
+		assert.ErrorIs(t, o.err, ErrInvalidTemplate, tmpl)
+		assert.Empty(t, o.subjectTemplate)
+	}
+
+	s := NewSubscriber(ctx, &fakeConn{}, WithSubjectTemplate("events.{svc}.{message}"), WithLogger(nopLogger{}))
+	err := s.Subscribe(&someService{})
+	assert.ErrorIs(t, err, ErrInvalidTemplate)
+	assert.Contains(t, err.Error(), "{svc}")
+	assert.Empty(t, s.Subscriptions())
+}
+
+func TestOptionsQueueName(t *testing.T) {
+	v := serviceMessage{serviceName: "someservice", messageName: "repaction", queue: true}
+	for _, c := range []struct {
+		opts  []Option
+		queue string
+	}{
+		{nil, "someservice_repaction"},
+		{[]Option{WithQueueSeparator("-")}, "someservice-repaction"},
+		{[]Option{WithSeparator(":")}, "someservice_repaction"},
+	} {
+		o := newOptions(c.opts...)
+		assert.Equal(t, c.queue, o.queueName(v))
+	}
+}
+
+func TestOptionsPrefixed(t *testing.T) {
+	o := newOptions()
+	assert.Equal(t, "timeservice.show", o.prefixed("timeservice.show"))
+	o = newOptions(WithSubjectPrefix("tenantA"))
+	assert.Equal(t, "tenantA.timeservice.show", o.prefixed("timeservice.show"))
+}
+
+func TestOptionsMessageName(t *testing.T) {
+	for _, c := range []struct {
+		style NamingStyle
+		name  string
+		want  string
+	}{
+		{NamingFlat, "SubAction", "subaction"},
+		{NamingKebab, "SubAction", "sub-action"},
+		{NamingSnake, "SubAction", "sub_action"},
+		{NamingDotted, "SubAction", "sub.action"},
+		{NamingKebab, "Action", "action"},
+		{NamingKebab, "Action2Run", "action2-run"},
+		{NamingKebab, "FetchURL", "fetch-url"},
+		{NamingKebab, "HTTPProxy", "http-proxy"},
+		{NamingSnake, "GetAPIKeyByID", "get_api_key_by_id"},
+		{NamingDotted, "URLParser", "url.parser"},
+		{NamingFlat, "HTTPProxy", "httpproxy"},
+	} {
+		o := newOptions(WithNamingStyle(c.style))
+		assert.Equal(t, c.want, o.messageName(c.name))
+	}
+}
+
+func TestOptionsStripPrefixes(t *testing.T) {
+	o := newOptions(WithStripPrefixes("Handle", "On"))
+	assert.Equal(t, "foo", o.messageName("HandleFoo"))
+	assert.Equal(t, "bar", o.messageName("OnBar"))
+	assert.Equal(t, "on", o.messageName("On"))
+	assert.Equal(t, "online", o.messageName("Online"))
+	assert.Equal(t, "other", o.messageName("Other"))
+	assert.Equal(t, "handlefoo", newOptions().messageName("HandleFoo"))
+}
+
+func TestOptionsServiceName(t *testing.T) {
+	typ := reflect.TypeOf(&someService{})
+	for _, c := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "someservice"},
+		{[]Option{WithNameTake(2)}, "subly.someservice"},
+		{[]Option{WithNameTake(2), WithNameDrop(1)}, "subly"},
+		{[]Option{WithNameDrop(1)}, "someservice"},
+		{[]Option{WithNameTake(5)}, "subly.someservice"},
+		{[]Option{WithNameTake(0)}, "someservice"},
+		{[]Option{WithNameTake(-1)}, "someservice"},
+	} {
+		assert.Equal(t, c.want, newOptions(c.opts...).serviceName(typ))
+	}
+}
+
+type levelLogger []string
+
+func (l *levelLogger) Printf(format string, v ...interface{}) { l.Logf(-1, format, v...) }
+
+func (l *levelLogger) Logf(level LogLevel, format string, v ...interface{}) {
+	*l = append(*l, level.String()+": "+fmt.Sprintf(format, v...))
+}
+
+func TestOptionsLogf(t *testing.T) {
+	var l levelLogger
+	o := newOptions(WithLogger(&l))
+	o.logf(LogInfo, "a")
+	o.logf(LogError, "b %d", 1)
+	assert.Equal(t, levelLogger{"info: a", "error: b 1"}, l)
+
+	l = nil
+	o = newOptions(WithLogger(&l), WithLogLevel(LogWarn))
+	o.logf(LogInfo, "a")
+	o.logf(LogWarn, "b")
+	assert.Equal(t, levelLogger{"warn: b"}, l)
+
+	rl := &recordLogger{}
+	o = newOptions(WithLogger(rl))
+	o.logf(LogWarn, "c")
+	assert.Equal(t, []string{"c"}, rl.lines)
+
+	rl = &recordLogger{}
+	o = newOptions(WithLogger(rl), WithSilent())
+	o.logf(LogError, "d")
+	assert.Empty(t, rl.lines)
+}
+
+// slogRecorder is a slog.Handler recording the level and message of each entry.
+type slogRecorder struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (*slogRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r *slogRecorder) Handle(_ context.Context, rec slog.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, rec.Level.String()+": "+rec.Message)
+	return nil
+}
+
+func (r *slogRecorder) WithAttrs([]slog.Attr) slog.Handler { return r }
+func (r *slogRecorder) WithGroup(string) slog.Handler      { return r }
+
+func TestOptionsSlog(t *testing.T) {
+	r := &slogRecorder{}
+	o := newOptions(WithSlog(slog.New(r)))
+	o.logf(LogInfo, "a %d", 1)
+	o.logf(LogWarn, "b %q", "x")
+	o.logf(LogError, "c %v", fmt.Errorf("failed"))
+	assert.Equal(t, []string{"INFO: a 1", `WARN: b "x"`, "ERROR: c failed"}, r.entries)
+
+	r = &slogRecorder{}
+	o = newOptions(WithSlog(slog.New(r)), WithLogLevel(LogWarn))
+	o.logf(LogInfo, "a")
+	o.logger.Printf("d %d", 2)
+	assert.Equal(t, []string{"ERROR: d 2"}, r.entries)
+}
@@ -0,0 +1,68 @@
+package subly
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// partitions queues messages per key, each queue being drained by its own goroutine,
+// which exits once the queue is empty.
+type partitions struct {
+	mu     sync.Mutex
+	queues map[string][]*nats.Msg
+}
+
+// partition returns a func(*nats.Msg) which runs the messages on subject with the same key in order,
+// and those with different keys concurrently, bounded by slots if not nil.
+func (s *Subscriber) partition(
+	subject string,
+	key func(payload interface{}) string,
+	payload func(*nats.Msg) (interface{}, error),
+	slots chan struct{},
+	run func(*nats.Msg),
+) func(*nats.Msg) {
+	p := &partitions{queues: make(map[string][]*nats.Msg)}
+	drain := func(k string) {
+		defer s.inflight.done()
+		for {
+			p.mu.Lock()
+			q := p.queues[k]
+			if len(q) == 0 {
+				delete(p.queues, k)
+				p.mu.Unlock()
+				return
+			}
+			m := q[0]
+			q[0] = nil
+			p.queues[k] = q[1:]
+			p.mu.Unlock()
+
+			if slots != nil {
+				slots <- struct{}{}
+			}
+			run(m)
+			if slots != nil {
+				<-slots
+			}
+		}
+	}
+	return func(m *nats.Msg) {
+		var k string
+		if v, err := payload(m); err == nil {
+			k = key(v)
+		}
+		p.mu.Lock()
+		q, busy := p.queues[k]
+		if !busy && !s.inflight.add() {
+			p.mu.Unlock()
+			s.opts.logf(LogInfo, "subly: skip message on %q, draining", subject)
+			return
+		}
+		p.queues[k] = append(q, m)
+		p.mu.Unlock()
+		if !busy {
+			go drain(k)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package subly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PublisherConn is the part of a NATS connection used by Publisher,
+// which *nats.EncodedConn satisfies.
+type PublisherConn interface {
+	Publish(subject string, v interface{}) error
+	RequestWithContext(ctx context.Context, subject string, v interface{}, vPtr interface{}) error
+}
+
+// ErrUnknownMethod is returned by Publisher, for methods which are not handlers of the service.
+var ErrUnknownMethod = errors.New("subly: unknown handler method")
+
+// ErrServiceByName is returned by Publisher, with WithPrefixFunc, for services given by
+// name, as the prefix of their subjects depends on their type.
+var ErrServiceByName = errors.New("subly: service given by name")
+
+// Publisher publishes to the subjects of services, derived the same way as Subscriber
+// does, so both sides agree on subjects when given the same options.
+type Publisher struct {
+	conn PublisherConn
+	opts *options
+}
+
+// NewPublisher creates new Publisher, deriving subjects using opts, like NewSubscriber.
+func NewPublisher(conn PublisherConn, opts ...Option) *Publisher {
+	return &Publisher{conn: conn, opts: newOptions(opts...)}
+}
+
+// Subject returns the subject of method of service. A service value, like
+// (*timeService)(nil), gets the exact subject Subscribe binds, and method is
+// the name of one of its handler methods, like ShowMessage. A string service
+// is used as the service name, and method can be given with or without its suffix.
+// With WithPrefixFunc, the prefix needs the type of the service, so a string service
+// fails with ErrServiceByName.
+func (p *Publisher) Subject(service interface{}, method string) (string, error) {
+	if p.opts.err != nil {
+		return "", p.opts.err
+	}
+	if name, ok := service.(string); ok {
+		if p.opts.prefixFunc != nil {
+			return "", fmt.Errorf("%w: %q, pass a service value with WithPrefixFunc", ErrServiceByName, name)
+		}
+		v, _ := p.opts.namedMessage(name, method)
+		return p.opts.subject(v), nil
+	}
+	for _, plan := range p.opts.plan(service) {
+		if plan.MethodName == method {
+			return plan.Subject, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %T.%s", ErrUnknownMethod, service, method)
+}
+
+// Publish publishes payload to the subject of method of service, see Subject.
+func (p *Publisher) Publish(service interface{}, method string, payload interface{}) error {
+	subject, err := p.Subject(service, method)
+	if err != nil {
+		return err
+	}
+	return p.conn.Publish(subject, payload)
+}
+
+// Request sends payload to the subject of method of service, see Subject,
+// and decodes the reply into reply.
+func (p *Publisher) Request(ctx context.Context, service interface{}, method string, payload, reply interface{}) error {
+	subject, err := p.Subject(service, method)
+	if err != nil {
+		return err
+	}
+	return p.conn.RequestWithContext(ctx, subject, payload, reply)
+}
@@ -0,0 +1,54 @@
+package subly
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// rawConn adapts a *nats.Conn to Conn. Replies of type []byte are published
+// as is, other values get encoded as JSON.
+type rawConn struct {
+	*nats.Conn
+	enc nats.Encoder
+}
+
+func (c *rawConn) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	h, ok := cb.(func(*nats.Msg))
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedSignature, cb)
+	}
+	return c.Conn.Subscribe(subject, h)
+}
+
+func (c *rawConn) QueueSubscribe(subject, queue string, cb nats.Handler) (*nats.Subscription, error) {
+	h, ok := cb.(func(*nats.Msg))
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedSignature, cb)
+	}
+	return c.Conn.QueueSubscribe(subject, queue, h)
+}
+
+func (c *rawConn) Publish(subject string, v interface{}) error {
+	if data, ok := v.([]byte); ok {
+		return c.Conn.Publish(subject, data)
+	}
+	data, err := c.enc.Encode(subject, v)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Publish(subject, data)
+}
+
+// NewRawSubscriber creates a Subscriber on a plain *nats.Conn, for handlers
+// which work with raw bytes:
+//
+//	handler := func(m *nats.Msg)
+//	handler := func(subject string, data []byte)
+//
+// Handlers taking other types get their messages decoded as JSON. A []byte
+// returned by a handler is published as is to the reply subject.
+func NewRawSubscriber(ctx context.Context, nc *nats.Conn, opts ...Option) *Subscriber {
+	return NewSubscriber(ctx, &rawConn{Conn: nc, enc: nats.EncoderForType(nats.JSON_ENCODER)}, opts...)
+}
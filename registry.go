@@ -0,0 +1,537 @@
+package subly
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrDuplicateSubject is returned, with WithNoDuplicates, when a subject would get bound twice.
+var ErrDuplicateSubject = errors.New("subly: duplicate subject")
+
+// subscription is a tracked subscription, along with the means to recreate it.
+type subscription struct {
+	sub       *nats.Subscription
+	subscribe func() (*nats.Subscription, error)
+	paused    bool
+}
+
+// ErrNotConnected is returned, with WithRequireConnected, for subscribing while
+// the connection is not connected.
+var ErrNotConnected = errors.New("subly: connection not ready")
+
+// subscribe creates a subscription using subscribe and tracks it.
+func (s *Subscriber) subscribe(subscribe func() (*nats.Subscription, error)) (*nats.Subscription, error) {
+	if err := s.ready(); err != nil {
+		return nil, err
+	}
+	sub, err := subscribe()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.track(&subscription{sub: sub, subscribe: subscribe}); err != nil {
+		return nil, err
+	}
+	s.emit(EventSubscribed, sub.Subject, nil)
+	return sub, nil
+}
+
+// ready fails with ErrNotConnected, when connection is required and not connected,
+// or with the configuration error, if any.
+func (s *Subscriber) ready() error {
+	if s.opts.err != nil {
+		return s.opts.err
+	}
+	if !s.opts.requireConnected {
+		return nil
+	}
+	nc, ok := s.natsConn()
+	if !ok || nc.IsConnected() {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrNotConnected, nc.Status())
+}
+
+// setup makes the subscriptions created by subscribe honor the pending limits,
+// unsubscribe automatically after max messages, if max is positive, and stop
+// getting tracked once closed. A recreated subscription counts max from zero again.
+func (s *Subscriber) setup(max int, subscribe func() (*nats.Subscription, error)) func() (*nats.Subscription, error) {
+	return func() (*nats.Subscription, error) {
+		sub, err := subscribe()
+		if err != nil {
+			return nil, err
+		}
+		if s.opts.pendingMsgs != 0 || s.opts.pendingBytes != 0 {
+			err = s.setPendingLimits(sub)
+		}
+		if err == nil && max > 0 {
+			err = sub.AutoUnsubscribe(max)
+		}
+		if err != nil {
+			_ = sub.Unsubscribe()
+			return nil, err
+		}
+		// nats.go may call it with its own locks held, as for channel subscriptions
+		sub.SetClosedHandler(func(string) { go s.finished(sub) })
+		return sub, nil
+	}
+}
+
+// finished stops tracking sub, once closed, like after receiving its max messages
+// or getting unsubscribed through its handle, so it does not get recreated by
+// resubscribe, and frees its subject for WithNoDuplicates. Paused subscriptions are kept,
+// and so are all when the connection got closed, for the teardown to report them.
+func (s *Subscriber) finished(sub *nats.Subscription) {
+	if nc, ok := s.natsConn(); ok && nc.IsClosed() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.subs {
+		if e.sub == sub && !e.paused {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			delete(s.bound, sub.Subject)
+			return
+		}
+	}
+}
+
+// setPendingLimits sets the configured pending limits on sub, keeping
+// the current value of a limit which is not set. Channel subscriptions have
+// no pending limits, their channel buffers the pending messages.
+func (s *Subscriber) setPendingLimits(sub *nats.Subscription) error {
+	if sub.Type() == nats.ChanSubscription {
+		return nil
+	}
+	msgs, bytes, err := sub.PendingLimits()
+	if err != nil {
+		return err
+	}
+	if s.opts.pendingMsgs != 0 {
+		msgs = s.opts.pendingMsgs
+	}
+	if s.opts.pendingBytes != 0 {
+		bytes = s.opts.pendingBytes
+	}
+	return sub.SetPendingLimits(msgs, bytes)
+}
+
+// track records e, to get unsubscribed (or drained) by the watcher when context got
+// canceled, unless Close takes care of it first, or teardown is manual.
+func (s *Subscriber) track(e *subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = e.sub.Unsubscribe()
+		return ErrClosed
+	}
+	s.subs = append(s.subs, e)
+	if s.opts.manualTeardown || s.watching {
+		return nil
+	}
+	s.watching = true
+	s.wg.Add(1)
+	go s.watch()
+	return nil
+}
+
+// watch waits for context to get canceled, and tears down the tracked subscriptions,
+// including those made after, unless Close takes care of it first.
+func (s *Subscriber) watch() {
+	defer s.wg.Done()
+	select {
+	case <-s.ctx.Done():
+	case <-s.done:
+		return
+	}
+	for {
+		s.mu.Lock()
+		subs := s.subs
+		s.subs = nil
+		if len(subs) == 0 {
+			s.watching = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		for _, e := range subs {
+			s.teardown(e.sub)
+		}
+	}
+}
+
+// teardown unsubscribes (or drains) sub. ErrBadSubscription means it is
+// already gone, like after reaching its auto unsubscribe limit.
+func (s *Subscriber) teardown(sub *nats.Subscription) {
+	if s.opts.drainOnCancel {
+		if err := sub.Drain(); !errors.Is(err, nats.ErrBadSubscription) {
+			s.emit(EventDrained, sub.Subject, err)
+			if err != nil {
+				s.opts.logf(LogError, "subly: drain %q: %v", sub.Subject, err)
+			}
+		}
+		return
+	}
+	if err := sub.Unsubscribe(); !errors.Is(err, nats.ErrBadSubscription) {
+		s.emit(EventUnsubscribed, sub.Subject, err)
+		if err != nil {
+			s.opts.logf(LogError, "subly: unsubscribe %q: %v", sub.Subject, err)
+		}
+	}
+}
+
+// noteBind records whether subject failed to bind, as reported by Healthy, and returns err.
+func (s *Subscriber) noteBind(subject string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failed, subject)
+		return nil
+	}
+	if s.failed == nil {
+		s.failed = make(map[string]bool)
+	}
+	s.failed[subject] = true
+	return err
+}
+
+// Healthy reports whether every subject the Subscriber was asked to bind is bound, along
+// with the sorted subjects which failed to bind, until they get bound by a later attempt.
+// It helps with readiness probes, for not routing traffic to a half subscribed instance.
+func (s *Subscriber) Healthy() (bool, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failed) == 0 {
+		return true, nil
+	}
+	res := make([]string, 0, len(s.failed))
+	for subject := range s.failed {
+		res = append(res, subject)
+	}
+	sort.Strings(res)
+	return false, res
+}
+
+// ErrInvalidSubject is returned, with WithSubjectValidation, for subjects which are not valid NATS subjects.
+var ErrInvalidSubject = errors.New("subly: invalid subject")
+
+// validate checks subject, of the handler named name, with WithSubjectValidation.
+func (s *Subscriber) validate(subject, name string) error {
+	if !s.opts.validateSubjects {
+		return nil
+	}
+	if reason := invalidSubject(subject); reason != "" {
+		return fmt.Errorf("%w: %s has %q, %s", ErrInvalidSubject, name, subject, reason)
+	}
+	return nil
+}
+
+// invalidSubject returns why subject is not a valid NATS subject, or nothing if it is.
+func invalidSubject(subject string) string {
+	if subject == "" {
+		return "it is empty"
+	}
+	if strings.ContainsAny(subject, " \t\r\n\x00") {
+		return "it contains whitespace or null"
+	}
+	if strings.HasPrefix(subject, ".") || strings.HasSuffix(subject, ".") {
+		return "it starts or ends with a dot"
+	}
+	if strings.Contains(subject, "..") {
+		return "it has an empty token"
+	}
+	return ""
+}
+
+// claim binds subject to the handler named name, failing with WithNoDuplicates
+// when the subject is already bound to another one.
+func (s *Subscriber) claim(subject, name string) error {
+	if !s.opts.noDuplicates {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.bound[subject]; ok {
+		return fmt.Errorf("%w: %s and %s", ErrDuplicateSubject, prev, name)
+	}
+	if s.bound == nil {
+		s.bound = make(map[string]string)
+	}
+	s.bound[subject] = name
+	return nil
+}
+
+// release unbinds subject, after failing to subscribe to it.
+func (s *Subscriber) release(subject string) {
+	if !s.opts.noDuplicates {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bound, subject)
+}
+
+// onReconnect registers resubscribe as a reconnect handler on the underlying
+// connection, keeping the handler which is already set.
+func (s *Subscriber) onReconnect() {
+	nc, ok := s.natsConn()
+	if !ok {
+		s.opts.logf(LogWarn, "subly: resubscribe on reconnect: %v", ErrUnsupportedConn)
+		return
+	}
+	prev := nc.Opts.ReconnectedCB
+	nc.SetReconnectHandler(func(c *nats.Conn) {
+		if prev != nil {
+			prev(c)
+		}
+		s.resubscribe()
+	})
+}
+
+// onAsyncError registers a handler for the asynchronous errors of the underlying
+// connection, like slow consumers, which reports those of the tracked subscriptions
+// to the error handler, keeping the handler which is already set.
+func (s *Subscriber) onAsyncError() {
+	nc, ok := s.natsConn()
+	if !ok {
+		s.opts.logf(LogWarn, "subly: error handler: %v", ErrUnsupportedConn)
+		return
+	}
+	prev := nc.Opts.AsyncErrorCB
+	nc.SetErrorHandler(func(c *nats.Conn, sub *nats.Subscription, err error) {
+		if prev != nil {
+			prev(c, sub, err)
+		}
+		if s.tracks(sub) {
+			s.opts.errorHandler(sub.Subject, err)
+		}
+	})
+}
+
+// tracks reports whether sub is one of the tracked subscriptions.
+func (s *Subscriber) tracks(sub *nats.Subscription) bool {
+	if sub == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.subs {
+		if e.sub == sub {
+			return true
+		}
+	}
+	return false
+}
+
+// resubscribe recreates the tracked subscriptions which are no longer valid.
+// They get recreated without holding the lock, as subscribing talks to the server,
+// and swapped in unless they got paused, removed or closed meanwhile.
+func (s *Subscriber) resubscribe() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	var stale []*subscription
+	prev := make(map[*subscription]*nats.Subscription)
+	for _, e := range s.subs {
+		if !e.paused && !e.sub.IsValid() {
+			stale = append(stale, e)
+			prev[e] = e.sub
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range stale {
+		subject := prev[e].Subject
+		sub, err := e.subscribe()
+		s.emit(EventResubscribed, subject, err)
+		if err != nil {
+			s.opts.logf(LogError, "subly: resubscribe %q: %v", subject, err)
+			continue
+		}
+		if !s.swap(e, prev[e], sub) {
+			_ = sub.Unsubscribe()
+		}
+	}
+}
+
+// swap replaces old by sub in e, reporting false when e is no longer tracked as is.
+func (s *Subscriber) swap(e *subscription, old, sub *nats.Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || e.paused || e.sub != old || !slices.Contains(s.subs, e) {
+		return false
+	}
+	e.sub = sub
+	return true
+}
+
+// ErrNotSubscribed is returned by Pause and Resume, for subjects which have
+// no subscription made by the Subscriber.
+var ErrNotSubscribed = errors.New("subly: not subscribed")
+
+// Pause stops handling messages on subject, the full subject as in Subscriptions,
+// by unsubscribing from it, until Resume gets called. Messages published meanwhile
+// are not received.
+func (s *Subscriber) Pause(subject string) error {
+	return s.pause(subject, true)
+}
+
+// Resume subscribes again to subject, paused by Pause, in the same queue group.
+func (s *Subscriber) Resume(subject string) error {
+	return s.pause(subject, false)
+}
+
+func (s *Subscriber) pause(subject string, pause bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	var (
+		found bool
+		errs  []error
+	)
+	for _, e := range s.subs {
+		if e.sub.Subject != subject {
+			continue
+		}
+		found = true
+		if e.paused == pause {
+			continue
+		}
+		if pause {
+			err := e.sub.Unsubscribe()
+			s.emit(EventPaused, subject, err)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("subly: pause %q: %w", subject, err))
+				continue
+			}
+			e.paused = true
+			continue
+		}
+		sub, err := e.subscribe()
+		s.emit(EventResumed, subject, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subly: resume %q: %w", subject, err))
+			continue
+		}
+		e.sub, e.paused = sub, false
+	}
+	if !found {
+		return fmt.Errorf("%w: %q", ErrNotSubscribed, subject)
+	}
+	return errors.Join(errs...)
+}
+
+// Unsubscribe unsubscribes the subscriptions Subscribe made for the methods of service,
+// matching them by subject and queue, so another implementation can take its place.
+// Subjects which are not subscribed are reported as ErrNotSubscribed, while the rest
+// still get unsubscribed.
+func (s *Subscriber) Unsubscribe(service interface{}) error {
+	var errs []error
+	for _, p := range s.Plan(service) {
+		e := s.remove(p.Subject, p.Queue)
+		if e == nil {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrNotSubscribed, p.Subject))
+			continue
+		}
+		s.release(p.Subject)
+		if !e.sub.IsValid() {
+			continue
+		}
+		err := e.sub.Unsubscribe()
+		s.emit(EventUnsubscribed, p.Subject, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subly: unsubscribe %q: %w", p.Subject, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replace swaps the subscriptions of service old for those of service new, like after
+// reloading its configuration. The methods of new get subscribed first, then the
+// subscriptions of old get drained, so both briefly overlap rather than dropping messages.
+// The subscriptions of old are kept for the subjects which new fails to bind.
+func (s *Subscriber) Replace(old, new interface{}) error {
+	oldPlans := s.Plan(old)
+	s.mu.Lock()
+	var prev []*subscription
+	for _, e := range s.subs {
+		for _, p := range oldPlans {
+			if e.sub.Subject == p.Subject && e.sub.Queue == p.Queue {
+				prev = append(prev, e)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, p := range oldPlans {
+		s.release(p.Subject)
+	}
+
+	var errs []error
+	if err := s.checkReceiver(new); err != nil {
+		errs = append(errs, err)
+	}
+	owner := fmt.Sprintf("%T", new)
+	failed := make(map[string]bool)
+	for _, p := range s.Plan(new) {
+		if p.shared && failed[p.Subject] {
+			continue // its first queue group failed to bind
+		}
+		if err := s.noteBind(p.Subject, s.bindPlan(owner, p)); err != nil {
+			errs = append(errs, err)
+			failed[p.Subject] = true
+		}
+	}
+
+	oldOwner := fmt.Sprintf("%T", old)
+	for _, e := range prev {
+		subject := e.sub.Subject
+		if failed[subject] {
+			_ = s.claim(subject, oldOwner)
+			continue
+		}
+		if !s.untrack(e) || !e.sub.IsValid() {
+			continue
+		}
+		err := e.sub.Drain()
+		s.emit(EventDrained, subject, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subly: drain %q: %w", subject, err))
+		}
+	}
+	return s.flushAfter(errors.Join(errs...))
+}
+
+// untrack stops tracking e, reporting whether it was tracked.
+func (s *Subscriber) untrack(e *subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.subs {
+		if v == e {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// remove stops tracking the subscription to subject in queue, and returns it, if any.
+func (s *Subscriber) remove(subject, queue string) *subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.subs {
+		if e.sub.Subject == subject && e.sub.Queue == queue {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package subly
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+type requestIDKey struct{}
+
+// RequestID returns the request ID of the message being handled, from the context
+// passed to handlers taking a context.Context, see WithAutoRequestID.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// withRequestID returns ctx carrying the request ID of m, which gets a new one
+// in its request ID header when the producer did not set it.
+func (s *Subscriber) withRequestID(ctx context.Context, m *nats.Msg) context.Context {
+	id := m.Header.Get(s.opts.requestIDHeader)
+	if id == "" {
+		id = newUUID()
+		if m.Header == nil {
+			m.Header = nats.Header{}
+		}
+		m.Header.Set(s.opts.requestIDHeader, id)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// newUUID returns a random, version 4, UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,64 @@
+package subly
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SubStats are the processing statistics of the messages on a subject, see Stats.
+type SubStats struct {
+	Received    uint64        `json:"received"`
+	Errors      uint64        `json:"errors"`
+	LastMessage time.Time     `json:"last_message"`
+	AvgLatency  time.Duration `json:"avg_latency"`
+}
+
+type subjectStats struct {
+	received uint64
+	errors   uint64
+	nanos    uint64 // total time spent handling
+	last     int64  // Unix nanoseconds of the last message
+}
+
+// Stats returns the processing statistics of the messages received on each subject,
+// as bound including the subject prefix, shared by the subscriptions to the same subject.
+// They are kept after unsubscribing.
+func (s *Subscriber) Stats() map[string]SubStats {
+	stats := make(map[string]SubStats)
+	s.stats.Range(func(k, v interface{}) bool {
+		st := v.(*subjectStats)
+		ss := SubStats{
+			Received: atomic.LoadUint64(&st.received),
+			Errors:   atomic.LoadUint64(&st.errors),
+		}
+		if last := atomic.LoadInt64(&st.last); last > 0 {
+			ss.LastMessage = time.Unix(0, last)
+		}
+		if ss.Received > 0 {
+			ss.AvgLatency = time.Duration(atomic.LoadUint64(&st.nanos) / ss.Received)
+		}
+		stats[k.(string)] = ss
+		return true
+	})
+	return stats
+}
+
+// count records the statistics of the messages handled by h, see Stats.
+func (s *Subscriber) count(subject string, h MsgHandler) MsgHandler {
+	v, _ := s.stats.LoadOrStore(subject, &subjectStats{})
+	st := v.(*subjectStats)
+	return func(ctx context.Context, m *nats.Msg) error {
+		start := time.Now()
+		atomic.StoreInt64(&st.last, start.UnixNano())
+		err := h(ctx, m)
+		atomic.AddUint64(&st.nanos, uint64(time.Since(start)))
+		atomic.AddUint64(&st.received, 1)
+		if err != nil {
+			atomic.AddUint64(&st.errors, 1)
+		}
+		return err
+	}
+}
@@ -16,12 +16,23 @@
 //
 // subject naming convension is <struct type name>.<method name> all lower case,
 // with words message and queue removed from the end.
+// The recognized suffixes can be changed using WithMessageSuffix and WithQueueSuffix.
+//
+// Methods promoted from embedded fields are subscribed under the name of the
+// embedding type, unless WithDeclaringServiceName is used.
+//
+// A service can set its own name, instead of the one derived from its type, by implementing
+// NamedService.
+// A service can bind some methods to other subjects by implementing SubjectOverrider,
+// and some queue methods to other queue groups by implementing QueueNamer, or to several
+// queue groups by implementing QueueGrouper.
+// Methods can bind wildcard subjects, using a marker in their names, see WithWildcardMarker.
 //
 // If a method name ends in Message, it will subscribe to subject as a normall
 // subscriber (just receiving). If a method name ends in MessageQueue, it will subscribe
 // to subject as a member of a queue and the queue name will be <struct type name>_<method name>.
 //
-// Message methods are expected to have one of four signatures.
+// Message methods are expected to have one of these signatures.
 //
 //	type person struct {
 //		Name string `json:"name,omitempty"`
@@ -33,34 +44,84 @@
 //	handler := func(subject string, o *obj)
 //	handler := func(subject, reply string, o *obj)
 //
-// Which are NATS's conventions for callbacks. A sample usage would look like:
+// Which are NATS's conventions for callbacks. To read headers next to the decoded
+// message, a handler can also take the raw message first:
+//
+//	handler := func(m *Msg, o *obj)
+//
+// To publish from inside a handler, or respond explicitly, it can take a *Context first:
+//
+//	handler := func(c *Context, o *obj)
+//
+// Payload types need not be exported, but with the JSON encoder, those which can never
+// get decoded, like structs without exported fields, get logged when subscribing, or
+// returned as an error with WithStrictSignatures.
+//
+// Handlers may also take a leading context.Context, derived from the context
+// of the Subscriber and carrying the message, for replying with Respond:
+//
+//	handler := func(ctx context.Context, p *person)
+//	handler := func(ctx context.Context, subject string, o *obj)
+//
+// Handlers may also return a value, an error or both. When the message has a reply
+// subject, the returned value, or an ErrorReply for a non-nil error, gets published to it:
+//
+//	handler := func(p *person) (*result, error)
+//
+// Replies are encoded with the encoder of the connection, so any encoding works, like
+// gob or protobuf. When the encoder cannot encode an ErrorReply, as with protobuf,
+// the error is sent in the Nats-Service-Error header of an empty reply instead,
+// unless WithErrorEncoder sets a payload of another shape.
+// A value returned after replying with Respond does not get published again, and
+// with WithReplyContext, middlewares can Respond for handlers of any signature.
+//
+// A sample usage would look like:
 //
 //	s := NewSubscriber(ctx, econn)
-//	s.Subscribe(&timeService{econn})
+//	if err := s.Subscribe(&timeService{econn}); err != nil {
+//		// some methods failed to subscribe
+//	}
 //
 // And the callback methods will unsubscribe from subject when context got canceled.
+// Panics inside callback methods are recovered and logged, see WithRecover.
+//
+// Messages are decoded by subly, using the encoder of the connection, so the raw
+// message, including its headers, is available to middlewares, see WithMiddleware.
+// Tracing is provided that way by package sublyotel.
+//
+// Subjects can be namespaced, for example per tenant, using WithSubjectPrefix:
+//
+//	s := NewSubscriber(ctx, econn, WithSubjectPrefix("tenantA"))
+//
+// which subscribes SubActionMessage to tenantA.someservice.subaction.
 package subly
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"reflect"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	nats "github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
 )
 
+var kindReplacer = strings.NewReplacer("(", "", ")", "", "*", "")
+
 func polishKindName(name string, take, drop int) string {
 	ix := strings.LastIndex(name, "/")
 	if ix > 0 && (ix+1) < len(name) {
 		name = name[ix+1:]
 	}
-	rp := strings.NewReplacer("(", "", ")", "", "*", "")
-	name = rp.Replace(name)
+	name = kindReplacer.Replace(name)
 	parts := strings.Split(name, ".")
-	if take < 0 {
-		take = 0
+	if take < 1 {
+		take = 1
 	}
 	if take < len(parts) {
 		parts = parts[(len(parts) - take):]
@@ -74,42 +135,149 @@ func polishKindName(name string, take, drop int) string {
 
 type serviceMessage struct {
 	queue                    bool
+	wildcard                 bool
 	serviceName, messageName string
+	methodName               string
 	message                  interface{}
+	subject                  string   // overridden subject, used verbatim
+	queueName                string   // overridden queue name, used verbatim
+	queueGroups              []string // overridden queue groups, see QueueGrouper
+	prefix                   string   // prefix of the service, used instead of the static one if ownPrefix
+	ownPrefix                bool     // see WithPrefixFunc
 }
 
-func getMessages(service interface{}) []serviceMessage {
-	var res []serviceMessage
+// NamedService can be implemented by a service to set the service part of its subjects
+// and queue names, decoupling them from the name of its type. It takes precedence over
+// WithServiceName and WithDeclaringServiceName, and is used as is.
+type NamedService interface {
+	ServiceName() string
+}
 
-	t := reflect.TypeOf(service)
-	val := reflect.ValueOf(service)
+// MessageSkipper can be implemented by a service to keep some of its methods, which
+// look like handlers by their names, from getting subscribed, see WithSkip.
+type MessageSkipper interface {
+	SkipMessages() []string
+}
+
+// SubjectOverrider can be implemented by a service to bind some of its
+// methods to subjects which do not follow the naming convention.
+// If SubjectFor returns false for a method, the derived subject is used.
+type SubjectOverrider interface {
+	SubjectFor(method string) (string, bool)
+}
+
+// QueueNamer can be implemented by a service to put some of its queue methods
+// in queue groups which do not follow the naming convention, for example to share
+// a queue group between services. If QueueName returns false for a method,
+// the derived queue name is used.
+type QueueNamer interface {
+	QueueName(method string) (string, bool)
+}
+
+// QueueGrouper can be implemented by a service to put some of its queue methods in
+// several queue groups, each getting its own subscription to the same subject, so
+// a message gets delivered to one member of each group. If QueueGroups returns
+// no groups for a method, QueueNamer or the naming convention applies.
+type QueueGrouper interface {
+	QueueGroups(method string) []string
+}
+
+// methodInfo is the part of a serviceMessage which only depends on the type
+// of the service, and gets cached per type.
+type methodInfo struct {
+	index                    int
+	queue                    bool
+	wildcard                 bool
+	serviceName, messageName string
+	methodName               string
+}
+
+// methods returns the handler methods of t, from cache if already discovered.
+func (o *options) methods(t reflect.Type) []methodInfo {
+	if cached, ok := o.methodCache.Load(t); ok {
+		return cached.([]methodInfo)
+	}
+
+	res := make([]methodInfo, 0, t.NumMethod())
+	serviceName := o.serviceName(t)
 	for i := 0; i < t.NumMethod(); i++ {
 		m := t.Method(i)
 
-		var isMessage, isMessageQueue bool
-		if strings.HasSuffix(m.Name, "Message") {
-			isMessage = true
-		}
-		if strings.HasSuffix(m.Name, "MessageQueue") {
-			isMessageQueue = true
-		}
-		if !isMessage && !isMessageQueue {
+		messageName, isHandler, isQueue := o.classify(m.Name)
+		if !isHandler || o.skip[m.Name] {
 			continue
 		}
+		messageName, wildcard := o.wildcard(messageName)
+		messageName = o.messageName(messageName)
 
-		messageName := strings.TrimSuffix(m.Name, "Queue")
-		messageName = strings.TrimSuffix(messageName, "Message")
-		messageName = strings.ToLower(messageName)
+		name := serviceName
+		if o.declaringServiceName {
+			if dt := declaringType(t, m.Name); dt != t {
+				name = o.serviceName(dt)
+			}
+		}
+		res = append(res, methodInfo{
+			index:       i,
+			serviceName: name,
+			messageName: messageName,
+			methodName:  m.Name,
+			queue:       isQueue,
+			wildcard:    wildcard,
+		})
+	}
+
+	o.methodCache.Store(t, res)
+	return res
+}
 
+func getMessages(service interface{}, o *options) []serviceMessage {
+	methods := o.methods(reflect.TypeOf(service))
+	res := make([]serviceMessage, 0, len(methods))
+
+	val := reflect.ValueOf(service)
+	overrider, _ := service.(SubjectOverrider)
+	namer, _ := service.(QueueNamer)
+	grouper, _ := service.(QueueGrouper)
+	var serviceName string
+	if named, ok := service.(NamedService); ok {
+		serviceName = named.ServiceName()
+	}
+	var prefix string
+	if o.prefixFunc != nil {
+		prefix = o.prefixFunc(reflect.TypeOf(service))
+	}
+	skip := skipped(service)
+	for _, m := range methods {
+		if slices.Contains(skip, m.methodName) {
+			continue
+		}
 		sm := serviceMessage{
-			message: val.MethodByName(m.Name).Interface(),
-			serviceName: strings.ToLower(
-				polishKindName(t.String(), 1, 0)),
-			messageName: messageName,
+			message:     val.Method(m.index).Interface(),
+			serviceName: m.serviceName,
+			messageName: m.messageName,
+			methodName:  m.methodName,
+			queue:       m.queue,
+			wildcard:    m.wildcard,
+			prefix:      prefix,
+			ownPrefix:   o.prefixFunc != nil,
+		}
+		if serviceName != "" {
+			sm.serviceName = serviceName
 		}
-		if isMessageQueue {
-			sm.queue = true
+		if overrider != nil {
+			if subject, ok := overrider.SubjectFor(m.methodName); ok {
+				sm.subject = subject
+			}
 		}
+		if namer != nil && sm.queue {
+			if queue, ok := namer.QueueName(m.methodName); ok {
+				sm.queueName = queue
+			}
+		}
+		if grouper != nil && sm.queue {
+			sm.queueGroups = grouper.QueueGroups(m.methodName)
+		}
+		o.forceDelivery(&sm)
 
 		res = append(res, sm)
 	}
@@ -117,107 +285,793 @@ func getMessages(service interface{}) []serviceMessage {
 	return res
 }
 
-func sub(
-	ctx context.Context,
-	econn *nats.EncodedConn,
-	subject string,
-	x interface{}) {
-	sub, err := econn.Subscribe(subject, x)
-	if err != nil {
-		log.Println("error:", err)
-		return
+// skipped returns the methods which service excludes by implementing MessageSkipper.
+func skipped(service interface{}) []string {
+	if skipper, ok := service.(MessageSkipper); ok {
+		return skipper.SkipMessages()
 	}
-	go func() {
-		<-ctx.Done()
-		err := sub.Unsubscribe()
-		if err != nil {
-			log.Println("error:", err)
+	return nil
+}
+
+// declaringType returns the type which declares method name of t,
+// following embedded fields for promoted methods.
+func declaringType(t reflect.Type, name string) reflect.Type {
+	if declares(t, name) || (t.Kind() == reflect.Ptr && declares(t.Elem(), name)) {
+		return t
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		return t
+	}
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() != reflect.Ptr && ft.Kind() != reflect.Interface {
+			ft = reflect.PtrTo(ft)
 		}
-	}()
+		if _, ok := ft.MethodByName(name); ok {
+			if ft.Kind() == reflect.Interface {
+				return ft
+			}
+			return declaringType(ft, name)
+		}
+	}
+	return t
 }
 
-func qsub(
-	ctx context.Context,
-	econn *nats.EncodedConn,
-	queue, subject string,
-	x interface{}) {
-	sub, err := econn.QueueSubscribe(subject, queue, x)
-	if err != nil {
-		log.Println("error:", err)
+// declares reports whether method name is declared on t itself, rather than
+// being promoted from an embedded field or being a pointer wrapper
+// for a value receiver, which are generated by the compiler.
+func declares(t reflect.Type, name string) bool {
+	m, ok := t.MethodByName(name)
+	if !ok {
+		return false
+	}
+	pc := m.Func.Pointer()
+	file, _ := runtime.FuncForPC(pc).FileLine(pc)
+	return file != "<autogenerated>"
+}
+
+func (s *Subscriber) sub(subject string, x interface{}) (*nats.Subscription, error) {
+	cb := s.handler(subject, x)
+	return s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return s.conn.Subscribe(subject, cb)
+	}))
+}
+
+func (s *Subscriber) qsub(queue, subject string, x interface{}) (*nats.Subscription, error) {
+	cb := s.handler(subject, x)
+	return s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return s.conn.QueueSubscribe(subject, queue, cb)
+	}))
+}
+
+// jsub is like sub and qsub, with extra JetStream subscription options.
+func (s *Subscriber) jsub(queue, subject string, x interface{}, opts []nats.SubOpt) (*nats.Subscription, error) {
+	c, ok := s.conn.(*jsConn)
+	if !ok {
+		return nil, fmt.Errorf("%w: subscription options need JetStream", ErrUnsupportedConn)
+	}
+	cb := s.handler(subject, x)
+	return s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return c.subscribe(subject, queue, cb, opts)
+	}))
+}
+
+// ErrNoMethods is returned, with WithErrorOnNoMethods, for services without handler methods.
+var ErrNoMethods = errors.New("subly: no handler methods")
+
+// ErrPointerReceiver is returned, in strict mode, when a service is passed by value
+// while some of its handler methods have pointer receivers, so they can not get subscribed.
+var ErrPointerReceiver = errors.New("subly: handler methods with pointer receiver")
+
+// checkReceiver reports the handler methods of service which get lost, because
+// service is not a pointer and they have pointer receivers. They get logged,
+// or returned as an error in strict mode. Skipped methods are left out.
+func (s *Subscriber) checkReceiver(service interface{}) error {
+	t := reflect.TypeOf(service)
+	if t == nil || t.Kind() == reflect.Ptr {
+		return nil
+	}
+	var lost []string
+	pt := reflect.PtrTo(t)
+	skip := skipped(service)
+	for i := 0; i < pt.NumMethod(); i++ {
+		name := pt.Method(i).Name
+		if _, isHandler, _ := s.opts.classify(name); !isHandler || s.opts.skip[name] || slices.Contains(skip, name) {
+			continue
+		}
+		if _, ok := t.MethodByName(name); !ok {
+			lost = append(lost, name)
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s of %v, pass a *%v instead", ErrPointerReceiver, strings.Join(lost, ", "), t, t)
+	if s.opts.strictSignatures {
+		return err
+	}
+	s.opts.logf(LogWarn, "%v", err)
+	return nil
+}
+
+// warnNearMisses logs the exported methods of service which are not handlers,
+// but whose names end within an edit distance of one from a recognized suffix,
+// as probable typos, like SubActionMesage. Skipped methods are left out.
+func (s *Subscriber) warnNearMisses(service interface{}) {
+	t := reflect.TypeOf(service)
+	if t == nil {
 		return
 	}
-	go func() {
-		<-ctx.Done()
-		err := sub.Unsubscribe()
-		if err != nil {
-			log.Println("error:", err)
+	suffixes := append(append([]string{}, s.opts.messageSuffix...), s.opts.queueSuffix...)
+	skip := skipped(service)
+	if _, ok := service.(MessageSkipper); ok {
+		skip = append(slices.Clip(skip), "SkipMessages") // near miss of Message itself
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		name := t.Method(i).Name
+		if _, isHandler, _ := s.opts.classify(name); isHandler || s.opts.skip[name] || slices.Contains(skip, name) {
+			continue
+		}
+		for _, suffix := range suffixes {
+			if nearSuffix(name, suffix) {
+				s.opts.logf(LogWarn, "subly: %v.%s is not a handler, probable typo of suffix %s", t, name, suffix)
+				break
+			}
+		}
+	}
+}
+
+// nearSuffix reports whether name ends within an edit distance of one from suffix.
+func nearSuffix(name, suffix string) bool {
+	if suffix == "" {
+		return false
+	}
+	for n := len(suffix) - 1; n <= len(suffix)+1; n++ {
+		if n > 0 && n < len(name) && editDistance(name[len(name)-n:], suffix) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
 		}
-	}()
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// ErrClosed is returned when subscribing using a closed Subscriber.
+var ErrClosed = errors.New("subly: subscriber closed")
+
+// Conn is the part of a NATS connection used by Subscriber,
+// which *nats.EncodedConn satisfies.
+type Conn interface {
+	Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error)
+	QueueSubscribe(subject, queue string, cb nats.Handler) (*nats.Subscription, error)
+	Publish(subject string, v interface{}) error
 }
 
 // Subscriber subscribes methods on a struct type as callbacks for NATS
 type Subscriber struct {
-	ctx   context.Context
-	econn *nats.EncodedConn
+	ctx  context.Context
+	conn Conn
+	enc  nats.Encoder
+	opts *options
+
+	jetStream bool // replies are acks, see NewJetStreamSubscriber
+
+	mu        sync.Mutex
+	subs      []*subscription
+	bound     map[string]string // subject -> handler name, see WithNoDuplicates
+	failed    map[string]bool   // subjects which failed to bind, see Healthy
+	fallbacks map[string]bool   // subjects of fallbacks, see SubscribeFallback
+	closed    bool
+	watching  bool // the teardown watcher is running, see track
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	inflight callbacks     // concurrent callbacks, see WithMaxConcurrency
+	pool     chan struct{} // slots shared by all subscriptions, see WithWorkerPool
+
+	events        chan Event
+	droppedEvents uint64
+
+	stats sync.Map // subject -> *subjectStats, see Stats
+}
+
+// NewSubscriber creates new Subscriber. When conn is a *nats.EncodedConn its
+// encoder is used for decoding messages in typed handlers, otherwise JSON.
+func NewSubscriber(ctx context.Context, conn Conn, opts ...Option) *Subscriber {
+	enc := nats.EncoderForType(nats.JSON_ENCODER)
+	if econn, ok := conn.(*nats.EncodedConn); ok && econn != nil {
+		enc = econn.Enc
+	}
+	s := &Subscriber{
+		ctx:    ctx,
+		conn:   conn,
+		enc:    enc,
+		opts:   newOptions(opts...),
+		done:   make(chan struct{}),
+		events: make(chan Event, eventBuffer),
+	}
+	if s.opts.workerPool > 0 {
+		s.pool = make(chan struct{}, s.opts.workerPool)
+	}
+	if s.opts.resubscribeOnReconnect {
+		s.onReconnect()
+	}
+	if s.opts.errorHandler != nil {
+		s.onAsyncError()
+	}
+	if s.opts.err != nil {
+		s.opts.logf(LogError, "%v", s.opts.err)
+	}
+	if _, ok := s.natsConn(); s.opts.requireConnected && !ok {
+		s.opts.logf(LogWarn, "subly: require connected: %v", ErrUnsupportedConn)
+	}
+	if _, ok := conn.(*jsConn); len(s.opts.subOpts) > 0 && !ok {
+		s.opts.logf(LogWarn, "subly: sub opts: %v: subscription options need JetStream", ErrUnsupportedConn)
+	}
+	return s
 }
 
-// NewSubscriber creates new Subscriber
-func NewSubscriber(ctx context.Context, econn *nats.EncodedConn) *Subscriber {
-	return &Subscriber{
-		ctx:   ctx,
-		econn: econn,
+// natsConn returns the underlying *nats.Conn, if any.
+func (s *Subscriber) natsConn() (*nats.Conn, bool) {
+	switch c := s.conn.(type) {
+	case *nats.EncodedConn:
+		if c != nil && c.Conn != nil {
+			return c.Conn, true
+		}
+	case *rawConn:
+		return c.Conn, c.Conn != nil
 	}
+	return nil, false
 }
 
-// Subscribe subscribes methods on a struct type as callbacks for NATS.
-// Message func signature must follow NATS conventions as described in package documentation.
-func (s *Subscriber) Subscribe(service interface{}) {
-	messages := getMessages(service)
+// Subscriptions returns the active subscriptions created by this Subscriber.
+// Each handle carries its Subject and Queue and can be used to inspect
+// pending counts and other runtime stats.
+func (s *Subscriber) Subscriptions() []*nats.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]*nats.Subscription, len(s.subs))
+	for i, e := range s.subs {
+		res[i] = e.sub
+	}
+	return res
+}
+
+// SubscriptionFor returns the active subscription to subject, as bound including
+// the subject prefix, created by this Subscriber. When subject is bound more than once,
+// like in several queue groups, the first one made is returned.
+// The subscription stays tracked, so it still gets unsubscribed when context got canceled.
+func (s *Subscriber) SubscriptionFor(subject string) (*nats.Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.subs {
+		if e.sub.Subject == subject {
+			return e.sub, true
+		}
+	}
+	return nil, false
+}
+
+// Close unsubscribes all subscriptions created by this Subscriber and waits
+// for their teardown to finish. It is safe to call Close after the context
+// got canceled, and more than once.
+func (s *Subscriber) Close() error {
+	subs := s.shutdown()
+	var errs []error
+	for _, e := range subs {
+		sub := e.sub
+		if !sub.IsValid() {
+			continue
+		}
+		err := sub.Unsubscribe()
+		s.emit(EventUnsubscribed, sub.Subject, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subly: unsubscribe %q: %w", sub.Subject, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Wait blocks until the subscriptions got torn down, after the context got canceled,
+// or Close got called. Combined with canceling the context, it makes sure every
+// subscription got unsubscribed (or drained) before shutting down. It must not be
+// called concurrently with subscribing.
+func (s *Subscriber) Wait() {
+	s.wg.Wait()
+}
+
+// ErrDrainTimeout is returned by DrainWithTimeout, when subscriptions did not
+// finish draining in time.
+var ErrDrainTimeout = errors.New("subly: drain timeout")
+
+// DrainWithTimeout drains all subscriptions created by this Subscriber, letting
+// the pending messages get handled, and waits up to d for them and the in-flight
+// callbacks to finish. When the deadline passes with work still pending, it returns
+// ErrDrainTimeout, reporting how many subscriptions or callbacks did not finish.
+// Once the subscriptions drained, or the deadline passed, messages still arriving
+// are not handled any more. Unlike Close, it does not drop pending messages.
+func (s *Subscriber) DrainWithTimeout(d time.Duration) error {
+	subs := s.shutdown()
+	deadline := time.Now().Add(d)
+
+	var errs []error
+	for _, e := range subs {
+		err := e.sub.Drain()
+		if errors.Is(err, nats.ErrBadSubscription) {
+			continue
+		}
+		s.emit(EventDrained, e.sub.Subject, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subly: drain %q: %w", e.sub.Subject, err))
+		}
+	}
+
+	pending := func() int {
+		n := 0
+		for _, e := range subs {
+			if e.sub.IsValid() {
+				n++
+			}
+		}
+		return n
+	}
+	for pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	idle, running := s.inflight.stop()
+	if n := pending(); n > 0 {
+		errs = append(errs, fmt.Errorf("%w: %d of %d subscriptions still draining", ErrDrainTimeout, n, len(subs)))
+		return errors.Join(errs...)
+	}
+	if running > 0 {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case <-idle:
+		case <-timer.C:
+			if _, running = s.inflight.stop(); running > 0 {
+				errs = append(errs, fmt.Errorf("%w: %d callbacks still running", ErrDrainTimeout, running))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// shutdown marks the Subscriber closed, stops the teardown watcher and returns
+// the tracked subscriptions, or nothing when it is already closed.
+func (s *Subscriber) shutdown() []*subscription {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return subs
+}
+
+// Plan describes a subscription that Subscribe would make for a method of a service.
+type Plan struct {
+	Subject    string
+	Queue      string
+	MethodName string
+	IsQueue    bool
+	IsWildcard bool // see WithWildcardMarker
+
+	handler interface{}
+	shared  bool // another queue group of the same method, see QueueGrouper
+}
+
+func (o *options) plan(service interface{}) []Plan {
+	messages := getMessages(service, o)
+	res := make([]Plan, 0, len(messages))
 	for _, v := range messages {
-		v := v
-		subject := fmt.Sprintf("%s.%s", v.serviceName, v.messageName)
+		p := Plan{
+			Subject:    o.subject(v),
+			MethodName: v.methodName,
+			IsQueue:    v.queue,
+			IsWildcard: v.wildcard && v.subject == "",
+			handler:    v.message,
+		}
+		if v.queue && len(v.queueGroups) > 0 {
+			for i, group := range v.queueGroups {
+				p.Queue = group
+				p.shared = i > 0
+				res = append(res, p)
+			}
+			continue
+		}
 		if v.queue {
-			queueName := fmt.Sprintf("%s_%s", v.serviceName, v.messageName)
-			qsub(
-				s.ctx,
-				s.econn,
-				queueName,
-				subject,
-				v.message)
+			p.Queue = o.queueName(v)
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// Plan returns the subscriptions Subscribe would make for service,
+// without calling NATS.
+func (s *Subscriber) Plan(service interface{}) []Plan {
+	return s.opts.plan(service)
+}
+
+// MessageInfo describes a handler method of a service, see Inspect.
+type MessageInfo struct {
+	MethodName  string
+	Subject     string
+	IsQueue     bool
+	Queue       string
+	PayloadType reflect.Type // type of the message argument, nil for unsupported signatures
+}
+
+// Inspect describes the handler methods of service, as Subscribe would bind them using
+// opts, without a connection. It helps with generating documentation and contract tests.
+func Inspect(service interface{}, opts ...Option) []MessageInfo {
+	var res []MessageInfo
+	for _, p := range newOptions(opts...).plan(service) {
+		mi := MessageInfo{
+			MethodName: p.MethodName,
+			Subject:    p.Subject,
+			IsQueue:    p.IsQueue,
+			Queue:      p.Queue,
+		}
+		if cb, err := parseCallback(p.handler); err == nil {
+			mi.PayloadType = cb.argType
+		}
+		res = append(res, mi)
+	}
+	return res
+}
+
+// Subscribe subscribes methods on a struct type as callbacks for NATS.
+// Message func signature must follow NATS conventions as described in package documentation.
+// All methods are attempted; failures are joined into the returned error.
+func (s *Subscriber) Subscribe(service interface{}) error {
+	return s.flushAfter(s.subscribePlans(service, s.Plan(service)))
+}
+
+// SubscribeAll subscribes the methods of all services, like Subscribe.
+// All services are attempted; failures, each naming the method of its service,
+// like *pkg.orderService.PlaceMessage, are joined into the returned error.
+func (s *Subscriber) SubscribeAll(services ...interface{}) error {
+	var errs []error
+	for _, service := range services {
+		if err := s.subscribePlans(service, s.Plan(service)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return s.flushAfter(errors.Join(errs...))
+}
+
+// SubscribeFiltered is like Subscribe, but only subscribes the methods
+// for which filter, given the method name, returns true.
+func (s *Subscriber) SubscribeFiltered(service interface{}, filter func(methodName string) bool) error {
+	var plans []Plan
+	for _, p := range s.Plan(service) {
+		if filter(p.MethodName) {
+			plans = append(plans, p)
+		}
+	}
+	return s.flushAfter(s.subscribePlans(service, plans))
+}
+
+func (s *Subscriber) subscribePlans(service interface{}, plans []Plan) error {
+	var errs []error
+	if err := s.checkReceiver(service); err != nil {
+		errs = append(errs, err)
+	}
+	if s.opts.warnNearMisses {
+		s.warnNearMisses(service)
+	}
+	if s.opts.errorOnNoMethods && !s.hasMethods(service) {
+		errs = append(errs, fmt.Errorf("%w: %T", ErrNoMethods, service))
+	}
+	errs = append(errs, s.bind(fmt.Sprintf("%T", service), plans)...)
+	return errors.Join(errs...)
+}
+
+// hasMethods reports whether service has handler methods, which are not skipped.
+func (s *Subscriber) hasMethods(service interface{}) bool {
+	skip := skipped(service)
+	for _, m := range s.opts.methods(reflect.TypeOf(service)) {
+		if !slices.Contains(skip, m.methodName) {
+			return true
+		}
+	}
+	return false
+}
+
+// bind subscribes plans, the handlers of owner, and returns the failures.
+func (s *Subscriber) bind(owner string, plans []Plan) []error {
+	var (
+		errs   []error
+		failed bool
+	)
+	for _, p := range plans {
+		if p.shared && failed {
+			continue // its first queue group failed to bind
+		}
+		err := s.noteBind(p.Subject, s.bindPlan(owner, p))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		failed = err != nil
+	}
+	return errs
+}
+
+func (s *Subscriber) bindPlan(owner string, p Plan) error {
+	name := owner + "." + p.MethodName
+	if err := s.check(name, p.handler); err != nil {
+		return err
+	}
+	if p.IsWildcard {
+		if err := s.checkWildcard(name, p.handler); err != nil {
+			return err
+		}
+	}
+	if err := s.checkPayload(name, p.handler); err != nil {
+		return err
+	}
+	if err := s.validate(p.Subject, name); err != nil {
+		return err
+	}
+	if !p.shared {
+		if err := s.claim(p.Subject, name); err != nil {
+			return subscribeError(p.Subject, err)
+		}
+	}
+	var err error
+	if p.IsQueue {
+		_, err = s.qsub(p.Queue, p.Subject, p.handler)
+	} else {
+		_, err = s.sub(p.Subject, p.handler)
+	}
+	if err != nil {
+		if !p.shared {
+			s.release(p.Subject)
+		}
+		return fmt.Errorf("subly: subscribe %q of %s: %w", p.Subject, name, err)
+	}
+	return nil
+}
+
+// SubscribeFuncNamed subscribes the funcs in handlers as if they were the methods of a service
+// named serviceName, keyed by their method names, like ShowMessage or WorkMessageQueue.
+// Subjects and queue names are derived by the same conventions as for Subscribe, with
+// serviceName used as is. Keys without a handler suffix are rejected.
+// Entries are subscribed in the sorted order of their keys, and all are attempted.
+func (s *Subscriber) SubscribeFuncNamed(serviceName string, handlers map[string]interface{}) error {
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	plans := make([]Plan, 0, len(handlers))
+	for _, name := range names {
+		v, ok := s.opts.namedMessage(serviceName, name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("subly: %s.%s does not end in a handler suffix", serviceName, name))
 			continue
 		}
-		sub(
-			s.ctx,
-			s.econn,
-			subject,
-			v.message)
+		p := Plan{
+			Subject:    s.opts.subject(v),
+			MethodName: name,
+			IsQueue:    v.queue,
+			IsWildcard: v.wildcard,
+			handler:    handlers[name],
+		}
+		if v.queue {
+			p.Queue = s.opts.queueName(v)
+		}
+		plans = append(plans, p)
 	}
+	errs = append(errs, s.bind(serviceName, plans)...)
+	return s.flushAfter(errors.Join(errs...))
 }
 
 // SubscribeFunc subscribes methods in values of the provided map as callbacks for NATS.
 // If queue name is provided, methods will get subscribed in the queue.
 // Message func signature must follow NATS conventions as described in package documentation.
-func (s *Subscriber) SubscribeFunc(messages map[string]interface{}, queue ...string) {
+// A value can also be a FuncEntry, or a pointer to one, setting the queue and the JetStream
+// subscription options of its key, which is used as its subject.
+// Entries are subscribed in the sorted order of their subjects, and subjects which differ
+// only in case are rejected as duplicates.
+// All entries are attempted; the subscriptions that got created are returned keyed by
+// their map key, and failures, naming the failed subjects, are joined into the returned error.
+func (s *Subscriber) SubscribeFunc(messages map[string]interface{}, queue ...string) (map[string]*nats.Subscription, error) {
 	var queueName string
 	if len(queue) > 0 {
 		queueName = queue[0]
 	}
-	for sb, m := range messages {
-		sb, m := sb, m
-		subject := sb
-		if queueName != "" {
-			qsub(
-				s.ctx,
-				s.econn,
-				queueName,
-				subject,
-				m)
+	subjects := make([]string, 0, len(messages))
+	for sb := range messages {
+		subjects = append(subjects, sb)
+	}
+	sort.Strings(subjects)
+
+	var errs []error
+	entries := make([]FuncEntry, 0, len(messages))
+	seen := make(map[string]string, len(messages))
+	for _, sb := range subjects {
+		folded := strings.ToLower(sb)
+		if prev, ok := seen[folded]; ok {
+			errs = append(errs, subscribeError(sb, fmt.Errorf("%w: %q and %q differ only in case", ErrDuplicateSubject, prev, sb)))
+			continue
+		}
+		seen[folded] = sb
+		e := FuncEntry{Handler: messages[sb], Queue: queueName}
+		switch v := messages[sb].(type) {
+		case FuncEntry:
+			e = v
+		case *FuncEntry:
+			if v != nil {
+				e = *v
+			}
+		}
+		e.Subject = sb
+		entries = append(entries, e)
+	}
+	subs, err := s.subscribeEntries(entries)
+	res := make(map[string]*nats.Subscription, len(subs))
+	for i, sub := range subs {
+		if sub != nil {
+			res[entries[i].Subject] = sub
+		}
+	}
+	return res, errors.Join(append(errs, err)...)
+}
+
+// SubscribeN subscribes handler to subject, like SubscribeFunc, and unsubscribes
+// automatically after max messages, or when context got canceled before that.
+// When the subscription gets recreated, by Resume or on reconnect, it counts
+// max messages from zero again.
+func (s *Subscriber) SubscribeN(subject string, max int, handler interface{}) (*nats.Subscription, error) {
+	subject = s.opts.prefixed(subject)
+	if err := s.check(subject, handler); err != nil {
+		return nil, s.noteBind(subject, err)
+	}
+	if err := s.checkPayload(subject, handler); err != nil {
+		return nil, s.noteBind(subject, err)
+	}
+	if err := s.validate(subject, subject); err != nil {
+		return nil, s.noteBind(subject, err)
+	}
+	if err := s.claim(subject, subject); err != nil {
+		return nil, s.noteBind(subject, subscribeError(subject, err))
+	}
+	cb := s.handler(subject, handler)
+	sub, err := s.subscribe(s.setup(max, func() (*nats.Subscription, error) {
+		return s.conn.Subscribe(subject, cb)
+	}))
+	if err != nil {
+		s.release(subject)
+		return nil, s.noteBind(subject, subscribeError(subject, err))
+	}
+	s.noteBind(subject, nil)
+	return sub, s.flushAfter(nil)
+}
+
+// FuncEntry is a callback to be subscribed by SubscribeFuncQueue, or SubscribeFunc.
+// When Queue is empty, it becomes a plain subscription.
+type FuncEntry struct {
+	Subject string
+	Handler interface{}
+	Queue   string
+	Opts    []nats.SubOpt // JetStream subscription options, applied after WithSubOpts
+}
+
+// SubscribeFuncQueue subscribes a mixed set of plain and queue callbacks, each
+// entry with its own queue name, in the provided order.
+// All entries are attempted; failures are joined into the returned error.
+func (s *Subscriber) SubscribeFuncQueue(entries []FuncEntry) error {
+	_, err := s.subscribeEntries(entries)
+	return err
+}
+
+// subscribeEntries returns the subscriptions in the order of entries,
+// nil for the failed ones.
+func (s *Subscriber) subscribeEntries(entries []FuncEntry) ([]*nats.Subscription, error) {
+	var errs []error
+	subs := make([]*nats.Subscription, len(entries))
+	for i, e := range entries {
+		subject := s.opts.prefixed(e.Subject)
+		sub, err := s.bindEntry(subject, e)
+		if err := s.noteBind(subject, err); err != nil {
+			errs = append(errs, err)
 			continue
 		}
-		sub(
-			s.ctx,
-			s.econn,
-			subject,
-			m)
+		subs[i] = sub
+	}
+	return subs, s.flushAfter(errors.Join(errs...))
+}
+
+func (s *Subscriber) bindEntry(subject string, e FuncEntry) (*nats.Subscription, error) {
+	if err := s.check(subject, e.Handler); err != nil {
+		return nil, err
+	}
+	if err := s.checkPayload(subject, e.Handler); err != nil {
+		return nil, err
+	}
+	if err := s.validate(subject, e.Subject); err != nil {
+		return nil, err
+	}
+	if err := s.claim(subject, e.Subject); err != nil {
+		return nil, subscribeError(subject, err)
 	}
+	var (
+		sub *nats.Subscription
+		err error
+	)
+	switch {
+	case len(e.Opts) > 0:
+		sub, err = s.jsub(e.Queue, subject, e.Handler, e.Opts)
+	case e.Queue != "":
+		sub, err = s.qsub(e.Queue, subject, e.Handler)
+	default:
+		sub, err = s.sub(subject, e.Handler)
+	}
+	if err != nil {
+		s.release(subject)
+		return nil, subscribeError(subject, err)
+	}
+	return sub, nil
+}
+
+// Flush makes sure the server has processed the subscriptions made so far,
+// so a message published right after is not missed.
+func (s *Subscriber) Flush() error {
+	f, ok := s.conn.(interface{ Flush() error })
+	if !ok {
+		return ErrUnsupportedConn
+	}
+	return f.Flush()
+}
+
+func (s *Subscriber) flushAfter(err error) error {
+	if !s.opts.flushAfterSubscribe {
+		return err
+	}
+	if ferr := s.Flush(); ferr != nil {
+		return errors.Join(err, fmt.Errorf("subly: flush: %w", ferr))
+	}
+	return err
+}
+
+func subscribeError(subject string, err error) error {
+	return fmt.Errorf("subly: subscribe %q: %w", subject, err)
 }
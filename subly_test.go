@@ -3,10 +3,12 @@ package subly
 import (
 	"context"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
-	nats "github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,7 +38,7 @@ func (*someService) Action1Message(p *person) {}
 func (*someService) Action2MessageQueue(subject, reply string, p *person) {}
 
 func TestGetMessages(t *testing.T) {
-	for _, v := range getMessages(&someService{}) {
+	for _, v := range getMessages(&someService{}, newOptions()) {
 		v := v
 		assert.Equal(t, v.serviceName, "someservice")
 		assert.Condition(t, func() bool {
@@ -70,6 +72,329 @@ func TestGetMessages(t *testing.T) {
 	}
 }
 
+type eventService struct{}
+
+func (*eventService) CreatedEvent(p *person) {}
+
+func (*eventService) UpdateCommandQueue(p *person) {}
+
+func (*eventService) DeleteMessage(p *person) {}
+
+func TestGetMessagesWithSuffix(t *testing.T) {
+	o := newOptions(
+		WithMessageSuffix("Event", "Command"),
+		WithQueueSuffix("EventQueue", "CommandQueue"))
+	queues := make(map[string]bool)
+	for _, v := range getMessages(&eventService{}, o) {
+		assert.Equal(t, "eventservice", v.serviceName)
+		queues[v.messageName] = v.queue
+	}
+	assert.Equal(t, map[string]bool{"created": false, "update": true}, queues)
+}
+
+func TestGetMessagesWithServiceName(t *testing.T) {
+	o := newOptions(WithServiceName(func(t reflect.Type) string {
+		name := strings.ToLower(t.Elem().Name())
+		return "billing." + strings.TrimSuffix(name, "service")
+	}))
+	for _, v := range getMessages(&someService{}, o) {
+		assert.Equal(t, "billing.some", v.serviceName)
+	}
+	assert.Equal(t, "billing.some.action1", o.subject(getMessages(&someService{}, o)[0]))
+}
+
+type legacyService struct{ someService }
+
+func (*legacyService) SubjectFor(method string) (string, bool) {
+	if method == "Action1Message" {
+		return "legacy.action.one", true
+	}
+	return "", false
+}
+
+func TestGetMessagesSubjectOverrider(t *testing.T) {
+	o := newOptions(WithSubjectPrefix("tenanta"))
+	subjects := make(map[string]string)
+	for _, v := range getMessages(&legacyService{}, o) {
+		subjects[v.messageName] = o.subject(v)
+	}
+	assert.Equal(t, map[string]string{
+		"action1": "legacy.action.one",
+		"action2": "tenanta.legacyservice.action2",
+	}, subjects)
+}
+
+type typoService struct{}
+
+func (*typoService) ActionMessage(p *person, subject string) {}
+
+type opaque struct{ id int }
+
+type opaqueService struct{}
+
+func (*opaqueService) OpaqueMessage(o *opaque)       {}
+func (*opaqueService) ChanMessage(c chan int)        {}
+func (*opaqueService) PersonMessage(p *person)       {}
+func (*opaqueService) EmptyMessage(e struct{})       {}
+func (*opaqueService) TimeMessage(t *time.Time)      {}
+func (*opaqueService) RawMessage(m *nats.Msg)        {}
+func (*opaqueService) EmbedMessage(e *workerService) {}
+
+func TestSubscribeUndecodablePayload(t *testing.T) {
+	logs := &recordLogger{}
+	s := NewSubscriber(ctx, &fakeConn{}, WithLogger(logs))
+	assert.NoError(t, s.Subscribe(&opaqueService{}))
+	assert.Len(t, s.Subscriptions(), 7)
+	assert.Equal(t, []string{
+		"subly: payload type can not be decoded: *subly.opaqueService.ChanMessage takes chan int, which JSON does not support",
+		"subly: payload type can not be decoded: *subly.opaqueService.OpaqueMessage takes *subly.opaque, which has no exported fields",
+	}, logs.lines)
+
+	s = NewSubscriber(ctx, &fakeConn{}, WithStrictSignatures())
+	err := s.Subscribe(&opaqueService{})
+	assert.ErrorIs(t, err, ErrUndecodablePayload)
+	assert.Len(t, s.Subscriptions(), 5)
+}
+
+func TestSubscribeStrictSignatures(t *testing.T) {
+	s := NewSubscriber(ctx, nil, WithStrictSignatures())
+	err := s.Subscribe(&typoService{})
+	assert.ErrorIs(t, err, ErrUnsupportedSignature)
+	assert.Contains(t, err.Error(), "ActionMessage")
+	assert.Empty(t, s.Subscriptions())
+}
+
+type baseService struct{}
+
+func (*baseService) PingMessage(p *person) {}
+
+func (baseService) StatusMessage(p *person) {}
+
+type userService struct {
+	baseService
+}
+
+func (*userService) CreateMessage(p *person) {}
+
+type orderService struct {
+	*baseService
+}
+
+func (*orderService) PingMessage(p *person) {}
+
+type mixedService struct{}
+
+func (mixedService) ValueMessage(p *person)    {}
+func (*mixedService) PointerMessage(p *person) {}
+
+type workerService struct{ someService }
+
+func (*workerService) QueueName(method string) (string, bool) {
+	if method == "Action2MessageQueue" {
+		return "workers", true
+	}
+	return "", false
+}
+
+func TestGetMessagesQueueNamer(t *testing.T) {
+	o := newOptions()
+	queues := make(map[string]string)
+	for _, v := range getMessages(&workerService{}, o) {
+		if v.queue {
+			queues[v.messageName] = o.queueName(v)
+		}
+	}
+	assert.Equal(t, map[string]string{"action2": "workers"}, queues)
+}
+
+type billingService struct{ someService }
+
+func (*billingService) ServiceName() string { return "billing" }
+
+func TestGetMessagesNamedService(t *testing.T) {
+	o := newOptions(WithServiceName(func(reflect.Type) string { return "other" }))
+	subjects := make(map[string]bool)
+	for _, v := range getMessages(&billingService{}, o) {
+		subjects[o.subject(v)] = true
+		if v.queue {
+			assert.Equal(t, "billing_"+v.messageName, o.queueName(v))
+		}
+	}
+	assert.True(t, subjects["billing.action1"], "%v", subjects)
+	assert.NotContains(t, subjects, "other.action1")
+}
+
+type formattingService struct{}
+
+func (*formattingService) CreateMessage(p *person)             {}
+func (*formattingService) FormatMessage(p *person) string      { return p.Name }
+func (*formattingService) DebugMessage(p *person)              {}
+func (*formattingService) SkipMessages() []string              { return []string{"DebugMessage"} }
+func (*formattingService) PurgeMessageQueue(p *person) *result { return nil }
+
+func TestGetMessagesSkip(t *testing.T) {
+	var methods []string
+	for _, v := range getMessages(&formattingService{}, newOptions(WithSkip("FormatMessage"))) {
+		methods = append(methods, v.methodName)
+	}
+	assert.Equal(t, []string{"CreateMessage", "PurgeMessageQueue"}, methods)
+
+	o := newOptions()
+	assert.Len(t, getMessages(&formattingService{}, o), 3)
+}
+
+func TestSubscribeErrorOnNoMethods(t *testing.T) {
+	type dependency struct{ URL string }
+
+	assert.NoError(t, NewSubscriber(ctx, &fakeConn{}).Subscribe(&dependency{}))
+
+	s := NewSubscriber(ctx, &fakeConn{}, WithErrorOnNoMethods())
+	assert.ErrorIs(t, s.Subscribe(&dependency{}), ErrNoMethods)
+	assert.NoError(t, s.Subscribe(&someService{}))
+	assert.NoError(t, s.SubscribeFiltered(&eventService{}, func(string) bool { return false }))
+}
+
+type skippingService struct{}
+
+func (skippingService) SkipMessages() []string    { return []string{"LegacyMessage", "DraftMesage"} }
+func (skippingService) LegacyMessage(p *person)   {}
+func (skippingService) DraftMesage(p *person)     {}
+func (*skippingService) PointerMessage(p *person) {}
+
+func TestSubscribeChecksSkip(t *testing.T) {
+	logs := &recordLogger{}
+	s := NewSubscriber(ctx, &fakeConn{}, WithLogger(logs), WithSkip("PointerMessage"),
+		WithStrictSignatures(), WithWarnNearMisses(), WithErrorOnNoMethods())
+	err := s.Subscribe(skippingService{})
+	assert.ErrorIs(t, err, ErrNoMethods)
+	assert.NotErrorIs(t, err, ErrPointerReceiver)
+	assert.Empty(t, logs.lines)
+
+	logs = &recordLogger{}
+	s = NewSubscriber(ctx, &fakeConn{}, WithLogger(logs), WithStrictSignatures(), WithWarnNearMisses())
+	assert.ErrorIs(t, s.Subscribe(skippingService{}), ErrPointerReceiver)
+	assert.Empty(t, logs.lines)
+}
+
+func TestGetMessagesPrefixFunc(t *testing.T) {
+	domain := func(t reflect.Type) string {
+		if t == reflect.TypeOf(&billingService{}) {
+			return "billing"
+		}
+		return ""
+	}
+	o := newOptions(WithSubjectPrefix("static"), WithPrefixFunc(domain))
+	var subjects []string
+	for _, service := range []interface{}{&billingService{}, &someService{}} {
+		for _, v := range getMessages(service, o) {
+			subjects = append(subjects, o.subject(v))
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"billing.billing.action1",
+		"billing.billing.action2",
+		"someservice.action1",
+		"someservice.action2",
+	}, subjects)
+	assert.Equal(t, "static.other", o.prefixed("other"))
+}
+
+func TestPlanForceDelivery(t *testing.T) {
+	queues := func(opts ...Option) map[string]string {
+		res := make(map[string]string)
+		for _, p := range NewSubscriber(ctx, &fakeConn{}, opts...).Plan(&someService{}) {
+			res[p.MethodName] = p.Queue
+		}
+		return res
+	}
+	assert.Equal(t, map[string]string{
+		"Action1Message":      "",
+		"Action2MessageQueue": "someservice_action2",
+	}, queues())
+	assert.Equal(t, map[string]string{
+		"Action1Message":      "someservice_action1",
+		"Action2MessageQueue": "",
+	}, queues(WithForceQueue("Action1Message", ""), WithForcePlain("someservice.action2")))
+	assert.Equal(t, map[string]string{
+		"Action1Message":      "workers",
+		"Action2MessageQueue": "someservice_action2",
+	}, queues(WithForcePlain("Action1Message"), WithForceQueue("someservice.action1", "workers")))
+}
+
+func TestSubscribePointerReceiver(t *testing.T) {
+	fc := &fakeConn{}
+	logs := &recordLogger{}
+	s := NewSubscriber(ctx, fc, WithLogger(logs))
+	assert.NoError(t, s.Subscribe(mixedService{}))
+	assert.Equal(t, []string{"mixedservice.value"}, fc.subjects)
+	if assert.Len(t, logs.lines, 1) {
+		assert.Contains(t, logs.lines[0], "PointerMessage")
+	}
+
+	s = NewSubscriber(ctx, &fakeConn{}, WithStrictSignatures())
+	err := s.Subscribe(mixedService{})
+	assert.ErrorIs(t, err, ErrPointerReceiver)
+	assert.Contains(t, err.Error(), "pass a *subly.mixedService")
+	assert.NoError(t, s.Subscribe(&mixedService{}))
+}
+
+func TestGetMessagesEmbedded(t *testing.T) {
+	names := func(service interface{}, opts ...Option) map[string]string {
+		res := make(map[string]string)
+		for _, v := range getMessages(service, newOptions(opts...)) {
+			res[v.messageName] = v.serviceName
+		}
+		return res
+	}
+
+	assert.Equal(t, map[string]string{
+		"ping":   "userservice",
+		"status": "userservice",
+		"create": "userservice",
+	}, names(&userService{}))
+	assert.Equal(t, map[string]string{
+		"ping":   "baseservice",
+		"status": "baseservice",
+		"create": "userservice",
+	}, names(&userService{}, WithDeclaringServiceName()))
+	assert.Equal(t, map[string]string{
+		"ping":   "orderservice",
+		"status": "baseservice",
+	}, names(&orderService{}, WithDeclaringServiceName()))
+}
+
+func TestGetMessagesInstances(t *testing.T) {
+	o := newOptions()
+	var called []int
+	for i := 0; i < 2; i++ {
+		for _, v := range getMessages(&counterService{n: i, called: &called}, o) {
+			v.message.(func(*person))(nil)
+		}
+	}
+	assert.Equal(t, []int{0, 1}, called)
+}
+
+type counterService struct {
+	n      int
+	called *[]int
+}
+
+func (cs *counterService) CountMessage(p *person) { *cs.called = append(*cs.called, cs.n) }
+
+func BenchmarkGetMessages(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		o := newOptions()
+		for i := 0; i < b.N; i++ {
+			getMessages(&timeService{}, o)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getMessages(&timeService{}, newOptions())
+		}
+	})
+}
+
 type TimeRequest struct {
 	From string `json:"from"`
 }
@@ -110,7 +435,9 @@ func TestSubscriber(t *testing.T) {
 	defer econn.Close()
 
 	s := NewSubscriber(ctx, econn)
-	s.Subscribe(&timeService{econn})
+	if !assert.NoError(t, s.Subscribe(&timeService{econn})) {
+		return
+	}
 
 	send := &TimeRequest{From: "dc0d"}
 	rply := &TimeResponse{}
@@ -152,3 +479,40 @@ func TestSubscriber(t *testing.T) {
 		return true
 	})
 }
+
+func TestInspect(t *testing.T) {
+	personType := reflect.TypeOf(&person{})
+	assert.Equal(t, []MessageInfo{
+		{MethodName: "Action1Message", Subject: "tenanta.someservice.action1", PayloadType: personType},
+		{MethodName: "Action2MessageQueue", Subject: "tenanta.someservice.action2", IsQueue: true, Queue: "someservice_action2", PayloadType: personType},
+	}, Inspect(&someService{}, WithSubjectPrefix("tenanta")))
+
+	infos := Inspect(&typoService{})
+	if assert.Len(t, infos, 1) {
+		assert.Nil(t, infos[0].PayloadType)
+	}
+}
+
+type typoSuffixService struct{ someService }
+
+func (*typoSuffixService) SubActionMesage(p *person) {}
+func (*typoSuffixService) SendMessages(p *person)    {}
+func (*typoSuffixService) WorkMessageQueu(p *person) {}
+func (*typoSuffixService) Passage(p *person)         {}
+func (*typoSuffixService) Close()                    {}
+
+func TestSubscribeWarnNearMisses(t *testing.T) {
+	logs := &recordLogger{}
+	s := NewSubscriber(ctx, &fakeConn{}, WithLogger(logs), WithWarnNearMisses())
+	assert.NoError(t, s.Subscribe(&typoSuffixService{}))
+	if assert.Len(t, logs.lines, 3) {
+		assert.Contains(t, logs.lines[0], "SendMessages")
+		assert.Contains(t, logs.lines[1], "SubActionMesage")
+		assert.Contains(t, logs.lines[2], "WorkMessageQueu")
+	}
+
+	logs = &recordLogger{}
+	s = NewSubscriber(ctx, &fakeConn{}, WithLogger(logs))
+	assert.NoError(t, s.Subscribe(&typoSuffixService{}))
+	assert.Empty(t, logs.lines)
+}
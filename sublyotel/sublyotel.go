@@ -0,0 +1,73 @@
+// Package sublyotel provides OpenTelemetry tracing for subly handlers.
+//
+// The W3C trace context is extracted from the headers of each incoming message,
+// and a span, named after the subject, is started around the handler. The span
+// is set on the context passed to context-aware handlers:
+//
+//	s := subly.NewSubscriber(ctx, econn, sublyotel.WithTracerProvider(tp))
+package sublyotel
+
+import (
+	"context"
+
+	"github.com/dc0d/subly"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/dc0d/subly/sublyotel"
+
+// HeaderCarrier adapts nats.Header to propagation.TextMapCarrier,
+// for injecting the trace context into published messages.
+type HeaderCarrier nats.Header
+
+// Get implements propagation.TextMapCarrier.
+func (hc HeaderCarrier) Get(key string) string { return nats.Header(hc).Get(key) }
+
+// Set implements propagation.TextMapCarrier.
+func (hc HeaderCarrier) Set(key, value string) { nats.Header(hc).Set(key, value) }
+
+// Keys implements propagation.TextMapCarrier.
+func (hc HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(hc))
+	for k := range hc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// WithTracerProvider makes the Subscriber trace each message handler,
+// using spans created by tp.
+func WithTracerProvider(tp trace.TracerProvider) subly.Option {
+	return subly.WithMiddleware(Middleware(tp))
+}
+
+// Middleware returns the tracing subly.Middleware used by WithTracerProvider.
+func Middleware(tp trace.TracerProvider) subly.Middleware {
+	tracer := tp.Tracer(instrumentationName)
+	propagator := propagation.TraceContext{}
+	return func(next subly.MsgHandler) subly.MsgHandler {
+		return func(ctx context.Context, m *nats.Msg) error {
+			if m.Header != nil {
+				ctx = propagator.Extract(ctx, HeaderCarrier(m.Header))
+			}
+			ctx, span := tracer.Start(ctx, m.Subject,
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("messaging.system", "nats"),
+					attribute.String("messaging.destination.name", m.Subject),
+				))
+			defer span.End()
+
+			err := next(ctx, m)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
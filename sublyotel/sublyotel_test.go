@@ -0,0 +1,46 @@
+package sublyotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMiddleware(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	// the producer side
+	pctx, parent := tp.Tracer("producer").Start(context.Background(), "publish")
+	m := &nats.Msg{Subject: "someservice.subaction", Header: nats.Header{}}
+	propagation.TraceContext{}.Inject(pctx, HeaderCarrier(m.Header))
+	parent.End()
+
+	var handlerSpan trace.SpanContext
+	failed := errors.New("failed")
+	h := Middleware(tp)(func(ctx context.Context, m *nats.Msg) error {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return failed
+	})
+	assert.ErrorIs(t, h(context.Background(), m), failed)
+
+	spans := sr.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	consumer := spans[1]
+	assert.Equal(t, "someservice.subaction", consumer.Name())
+	assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+	assert.Equal(t, parent.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+	assert.Equal(t, parent.SpanContext().SpanID(), consumer.Parent().SpanID())
+	assert.Equal(t, consumer.SpanContext().SpanID(), handlerSpan.SpanID())
+	assert.Equal(t, codes.Error, consumer.Status().Code)
+}
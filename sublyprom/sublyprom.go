@@ -0,0 +1,65 @@
+// Package sublyprom provides a Prometheus backed subly.Metrics, which counts
+// handled messages, errors and expired messages and records handler latency, per subject.
+package sublyprom
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dc0d/subly"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements subly.Metrics using Prometheus collectors.
+type Metrics struct {
+	messages *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	expired  *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// New creates Metrics, with collectors named <namespace>_messages_total,
+// <namespace>_errors_total, <namespace>_expired_total and <namespace>_handler_seconds,
+// registered with reg.
+func New(reg prometheus.Registerer, namespace string) (*Metrics, error) {
+	m := &Metrics{
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_total",
+			Help:      "Number of messages handled, per subject.",
+		}, []string{"subject"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of handler errors, per subject.",
+		}, []string{"subject"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "expired_total",
+			Help:      "Number of messages dropped past their deadline, per subject.",
+		}, []string{"subject"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_seconds",
+			Help:      "Time spent in handlers, per subject.",
+		}, []string{"subject"}),
+	}
+	for _, c := range []prometheus.Collector{m.messages, m.errors, m.expired, m.latency} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Observe implements subly.Metrics.
+func (m *Metrics) Observe(subject string, dur time.Duration, err error) {
+	m.messages.WithLabelValues(subject).Inc()
+	if err != nil {
+		m.errors.WithLabelValues(subject).Inc()
+	}
+	if errors.Is(err, subly.ErrExpired) {
+		m.expired.WithLabelValues(subject).Inc()
+	}
+	m.latency.WithLabelValues(subject).Observe(dur.Seconds())
+}
@@ -0,0 +1,35 @@
+package sublyprom
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dc0d/subly"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ subly.Metrics = (*Metrics)(nil)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg, "subly")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m.Observe("someservice.subaction", time.Millisecond, nil)
+	m.Observe("someservice.subaction", time.Millisecond, errors.New("failed"))
+	m.Observe("someservice.subaction", 0, fmt.Errorf("%w at noon", subly.ErrExpired))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.messages.WithLabelValues("someservice.subaction")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.errors.WithLabelValues("someservice.subaction")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.expired.WithLabelValues("someservice.subaction")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.latency))
+
+	_, err = New(reg, "subly")
+	assert.Error(t, err)
+}
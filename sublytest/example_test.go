@@ -0,0 +1,55 @@
+package sublytest_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dc0d/subly"
+	"github.com/dc0d/subly/sublytest"
+)
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+type greetService struct {
+	greeted chan string
+}
+
+func (gs *greetService) HelloMessage(g *greeting) {
+	gs.greeted <- g.Name
+}
+
+func ExampleRunServer() {
+	econn, cleanup, err := sublytest.RunServer()
+	if err != nil {
+		panic(err)
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := &greetService{greeted: make(chan string, 1)}
+	s := subly.NewSubscriber(ctx, econn)
+	if err := s.Subscribe(srv); err != nil {
+		panic(err)
+	}
+	if err := econn.Flush(); err != nil {
+		panic(err)
+	}
+
+	if err := econn.Publish("greetservice.hello", &greeting{Name: "dc0d"}); err != nil {
+		panic(err)
+	}
+	select {
+	case name := <-srv.greeted:
+		fmt.Println("greeted", name)
+	case <-time.After(time.Second * 3):
+		fmt.Println("handler did not fire")
+	}
+
+	// Output:
+	// greeted dc0d
+}
@@ -0,0 +1,36 @@
+// Package sublytest helps with testing subly services end-to-end, against an
+// in-process NATS server, without wiring nats-server manually.
+package sublytest
+
+import (
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// RunServer starts an in-process NATS server on a random port and returns
+// a connected *nats.EncodedConn, using the json encoder, and a cleanup func
+// which closes the connection and shuts the server down.
+func RunServer() (*nats.EncodedConn, func(), error) {
+	opts := test.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	srv := test.RunServer(&opts)
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		srv.Shutdown()
+		return nil, nil, err
+	}
+	econn, err := nats.NewEncodedConn(conn, nats.JSON_ENCODER)
+	if err != nil {
+		conn.Close()
+		srv.Shutdown()
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		econn.Close()
+		srv.Shutdown()
+	}
+	return econn, cleanup, nil
+}
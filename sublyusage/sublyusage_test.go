@@ -2,13 +2,20 @@ package sublyusage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dc0d/subly"
-	nats "github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/encoders/protobuf"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var (
@@ -66,7 +73,9 @@ func TestSubscriberSubscribe(t *testing.T) {
 	defer econn.Close()
 
 	s := subly.NewSubscriber(ctx, econn)
-	s.Subscribe(&timeService{econn})
+	if !assert.NoError(t, s.Subscribe(&timeService{econn})) {
+		return
+	}
 
 	send := &TimeRequest{From: "dc0d"}
 	rply := &TimeResponse{}
@@ -124,15 +133,21 @@ func TestSubscriberSubscribeFunc(t *testing.T) {
 	s := subly.NewSubscriber(ctx, econn)
 	{
 		srv := &timeService{econn}
-		s.SubscribeFunc(
+		_, err = s.SubscribeFunc(
 			map[string]interface{}{
 				"timeservice.show": srv.ShowMessage,
 				"timeservice.tell": srv.TellMessage,
 			})
-		s.SubscribeFunc(
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = s.SubscribeFunc(
 			map[string]interface{}{
 				"timeservice.wait": srv.WaitMessageQueue,
 			}, "timeservice_wait")
+		if !assert.NoError(t, err) {
+			return
+		}
 	}
 
 	send := &TimeRequest{From: "dc0d"}
@@ -175,3 +190,1263 @@ func TestSubscriberSubscribeFunc(t *testing.T) {
 		return true
 	})
 }
+
+func TestSubscriberSubscribeFuncError(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	srv := &timeService{econn}
+	subs, err := s.SubscribeFunc(
+		map[string]interface{}{
+			"":                 srv.ShowMessage,
+			"timeservice.tell": srv.TellMessage,
+		})
+	assert.ErrorIs(t, err, nats.ErrBadSubject)
+	assert.Len(t, subs, 1)
+	assert.NotNil(t, subs["timeservice.tell"])
+}
+
+func TestSubscriberWithRequireConnected(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithRequireConnected())
+	err = s.Subscribe(&timeService{econn})
+	assert.ErrorIs(t, err, subly.ErrNotConnected)
+	assert.Empty(t, s.Subscriptions())
+	ok, failed := s.Healthy()
+	assert.False(t, ok)
+	assert.NotEmpty(t, failed)
+}
+
+func TestSubscriberClose(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := subly.NewSubscriber(ctx, econn)
+	if !assert.NoError(t, s.Subscribe(&timeService{econn})) {
+		return
+	}
+
+	rply := &TimeResponse{}
+	err = econn.Request("timeservice.tell", &TimeRequest{From: "dc0d"}, rply, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, s.Close())
+	err = econn.Request("timeservice.tell", &TimeRequest{From: "dc0d"}, rply, time.Millisecond*300)
+	assert.Error(t, err)
+
+	cancel()
+	assert.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Subscribe(&timeService{econn}), subly.ErrClosed)
+}
+
+func TestSubscriberSubscriptions(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	if !assert.NoError(t, s.Subscribe(&timeService{econn})) {
+		return
+	}
+
+	queues := make(map[string]string)
+	for _, sub := range s.Subscriptions() {
+		queues[sub.Subject] = sub.Queue
+	}
+	assert.Equal(t, map[string]string{
+		"timeservice.show": "",
+		"timeservice.tell": "",
+		"timeservice.wait": "timeservice_wait",
+	}, queues)
+
+	assert.NoError(t, s.Close())
+	assert.Empty(t, s.Subscriptions())
+}
+
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) { l <- fmt.Sprintf(format, v...) }
+
+func TestSubscriberWithLogger(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	logs := make(chanLogger, 10)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := subly.NewSubscriber(ctx, econn, subly.WithLogger(logs))
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.show": (&timeService{econn}).ShowMessage,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	econn.Close()
+	cancel()
+	select {
+	case l := <-logs:
+		assert.Contains(t, l, "timeservice.show")
+	case <-time.After(time.Second * 3):
+		t.Fail()
+	}
+}
+
+func TestSubscriberWithSubjectPrefix(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithSubjectPrefix("tenanta"))
+	defer s.Close()
+	srv := &timeService{econn}
+	if !assert.NoError(t, s.Subscribe(srv)) {
+		return
+	}
+	_, err = s.SubscribeFunc(map[string]interface{}{"timeservice.tellfunc": srv.TellMessage})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, subject := range []string{"tenanta.timeservice.tell", "tenanta.timeservice.tellfunc"} {
+		rply := &TimeResponse{}
+		err = econn.Request(subject, &TimeRequest{From: "dc0d"}, rply, time.Second)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "dc0d", rply.From)
+	}
+}
+
+func TestSubscriberWithDrainOnCancel(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	const count = 5
+	started := make(chan struct{}, count)
+	handled := make(chan struct{}, count)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := subly.NewSubscriber(ctx, econn, subly.WithDrainOnCancel())
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.slow": func(tr *TimeRequest) {
+			started <- struct{}{}
+			time.Sleep(time.Millisecond * 50)
+			handled <- struct{}{}
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		assert.NoError(t, econn.Publish("timeservice.slow", &TimeRequest{From: "dc0d"}))
+	}
+	assert.NoError(t, econn.Flush())
+	<-started
+	cancel()
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 3):
+			t.Fatal("pending message got dropped")
+		}
+	}
+}
+
+func TestSubscriberPlan(t *testing.T) {
+	s := subly.NewSubscriber(ctx, nil)
+	plans := make(map[string]subly.Plan)
+	for _, p := range s.Plan(&timeService{}) {
+		plans[p.MethodName] = p
+	}
+	assert.Len(t, plans, 3)
+	assert.Equal(t, "timeservice.show", plans["ShowMessage"].Subject)
+	assert.False(t, plans["ShowMessage"].IsQueue)
+	assert.Equal(t, "timeservice.tell", plans["TellMessage"].Subject)
+	assert.Equal(t, "timeservice.wait", plans["WaitMessageQueue"].Subject)
+	assert.True(t, plans["WaitMessageQueue"].IsQueue)
+	assert.Equal(t, "timeservice_wait", plans["WaitMessageQueue"].Queue)
+}
+
+func TestSubscriberContextHandler(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.ctx": func(ctx context.Context, subject, reply string, tr *TimeRequest) {
+			econn.Publish(reply, &TimeResponse{From: tr.From, T: time.Now()})
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rply := &TimeResponse{}
+	err = econn.Request("timeservice.ctx", &TimeRequest{From: "dc0d"}, rply, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "dc0d", rply.From)
+}
+
+func TestSubscriberReplyResults(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.now": func(tr *TimeRequest) *TimeResponse {
+			return &TimeResponse{From: tr.From, T: time.Now()}
+		},
+		"timeservice.nowctx": func(ctx context.Context, subject string, tr *TimeRequest) (*TimeResponse, error) {
+			if tr.From == "" {
+				return nil, errors.New("from is required")
+			}
+			return &TimeResponse{From: tr.From, T: time.Now()}, nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rply := &TimeResponse{}
+	err = econn.Request("timeservice.now", &TimeRequest{From: "dc0d"}, rply, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dc0d", rply.From)
+	}
+
+	rply = &TimeResponse{}
+	err = econn.Request("timeservice.nowctx", &TimeRequest{From: "dc0d"}, rply, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dc0d", rply.From)
+	}
+
+	erply := &subly.ErrorReply{}
+	err = econn.Request("timeservice.nowctx", &TimeRequest{}, erply, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "from is required", erply.Error)
+	}
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	got := make(chan TimeRequest, 2)
+	handler := func(tr *TimeRequest) { got <- *tr }
+	if !assert.NoError(t, subly.SubscribeTyped(s, "timeservice.typed", handler)) {
+		return
+	}
+	if !assert.NoError(t, subly.QueueSubscribeTyped(s, "timeservice.typedq", "timeservice_typedq", handler)) {
+		return
+	}
+
+	for _, subject := range []string{"timeservice.typed", "timeservice.typedq"} {
+		assert.NoError(t, econn.Publish(subject, &TimeRequest{From: subject}))
+		select {
+		case tr := <-got:
+			assert.Equal(t, subject, tr.From)
+		case <-time.After(time.Second * 3):
+			t.Fail()
+		}
+	}
+}
+
+func TestSubscriberSubscribeChan(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	ch := make(chan *nats.Msg, 2)
+	if _, err := s.SubscribeChan("timeservice.chan", ch); !assert.NoError(t, err) {
+		return
+	}
+	sub, err := s.QueueSubscribeChan("timeservice.chanq", "timeservice_chanq", ch)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "timeservice_chanq", sub.Queue)
+
+	for _, subject := range []string{"timeservice.chan", "timeservice.chanq"} {
+		assert.NoError(t, econn.Publish(subject, &TimeRequest{From: "dc0d"}))
+		select {
+		case m := <-ch:
+			assert.Equal(t, subject, m.Subject)
+		case <-time.After(time.Second * 3):
+			t.Fail()
+		}
+	}
+}
+
+func TestSubscriberWithResubscribeOnReconnect(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	conn, err := nats.Connect(nats.DefaultURL, nats.ReconnectHandler(func(*nats.Conn) {
+		reconnected <- struct{}{}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithResubscribeOnReconnect())
+	defer s.Close()
+
+	conn.Opts.ReconnectedCB(conn)
+	select {
+	case <-reconnected:
+	default:
+		t.Fatal("existing reconnect handler got replaced")
+	}
+}
+
+func TestSubscriberResubscribeSkipsFinished(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithResubscribeOnReconnect())
+	defer s.Close()
+	received := make(chan string, 2)
+	if _, err := s.SubscribeN("resubscribe.once", 1, func(tr *TimeRequest) { received <- tr.From }); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := s.SubscribeFunc(map[string]interface{}{
+		"resubscribe.unsubscribed": func(tr *TimeRequest) { received <- tr.From },
+		"resubscribe.kept":         func(tr *TimeRequest) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, subs["resubscribe.unsubscribed"].Unsubscribe())
+
+	assert.NoError(t, econn.Publish("resubscribe.once", &TimeRequest{From: "before"}))
+	assert.Equal(t, "before", <-received)
+	assert.Eventually(t, func() bool {
+		return len(s.Subscriptions()) == 1
+	}, time.Second, time.Millisecond*10)
+
+	conn.Opts.ReconnectedCB(conn)
+	assert.NoError(t, econn.Publish("resubscribe.once", &TimeRequest{From: "after-reconnect"}))
+	assert.NoError(t, econn.Publish("resubscribe.unsubscribed", &TimeRequest{From: "after-reconnect"}))
+	assert.NoError(t, econn.Flush())
+	select {
+	case from := <-received:
+		t.Fatalf("closed subscription got recreated, received %q", from)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if subs := s.Subscriptions(); assert.Len(t, subs, 1) {
+		assert.Equal(t, "resubscribe.kept", subs[0].Subject)
+	}
+}
+
+type orderService struct {
+	placed  chan string
+	shipped chan string
+}
+
+func (svc *orderService) PlaceMessage(tr *TimeRequest) { svc.placed <- tr.From }
+
+func (svc *orderService) ShipMessageQueue(tr *TimeRequest) { svc.shipped <- tr.From }
+
+func TestJetStreamSubscriber(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "ORDERSERVICE", Subjects: []string{"orderservice.>"}}); err != nil {
+		t.Skip("jetstream:", err)
+	}
+	defer js.DeleteStream("ORDERSERVICE")
+
+	svc := &orderService{placed: make(chan string, 1), shipped: make(chan string, 1)}
+	s := subly.NewJetStreamSubscriber(ctx, js)
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(svc)) {
+		return
+	}
+	info, err := js.ConsumerInfo("ORDERSERVICE", "orderservice_ship")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "orderservice_ship", info.Config.DeliverGroup)
+	}
+
+	for subject, ch := range map[string]chan string{"orderservice.place": svc.placed, "orderservice.ship": svc.shipped} {
+		_, err := js.Publish(subject, []byte(`{"from":"dc0d"}`))
+		assert.NoError(t, err)
+		select {
+		case from := <-ch:
+			assert.Equal(t, "dc0d", from)
+		case <-time.After(time.Second * 3):
+			t.Fatal("no message on", subject)
+		}
+	}
+
+	s.Close()
+	_, err = js.ConsumerInfo("ORDERSERVICE", "orderservice_ship")
+	assert.NoError(t, err, "durable consumer got deleted on teardown")
+
+	s = subly.NewJetStreamSubscriber(ctx, js)
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(svc)) {
+		return
+	}
+	select {
+	case <-svc.shipped:
+		t.Fatal("message got delivered again")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+type paymentService struct {
+	attempts chan int
+	acked    chan string
+	tries    int
+}
+
+func (svc *paymentService) ChargeMessage(tr *TimeRequest) error {
+	svc.tries++
+	svc.attempts <- svc.tries
+	if svc.tries == 1 {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (svc *paymentService) RefundMessage(m *nats.Msg) {
+	svc.acked <- m.Subject
+	m.Ack()
+}
+
+func TestJetStreamSubscriberWithManualAck(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "PAYMENTSERVICE", Subjects: []string{"paymentservice.>"}}); err != nil {
+		t.Skip("jetstream:", err)
+	}
+	defer js.DeleteStream("PAYMENTSERVICE")
+
+	svc := &paymentService{attempts: make(chan int, 3), acked: make(chan string, 1)}
+	s := subly.NewJetStreamSubscriber(ctx, js, subly.WithManualAck())
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(svc)) {
+		return
+	}
+
+	_, err = js.Publish("paymentservice.charge", []byte(`{"from":"dc0d"}`))
+	assert.NoError(t, err)
+	for _, want := range []int{1, 2} {
+		select {
+		case got := <-svc.attempts:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second * 3):
+			t.Fatal("no redelivery after nak")
+		}
+	}
+
+	_, err = js.Publish("paymentservice.refund", []byte(`{"from":"dc0d"}`))
+	assert.NoError(t, err)
+	select {
+	case subject := <-svc.acked:
+		assert.Equal(t, "paymentservice.refund", subject)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+}
+
+func TestJetStreamSubscriberWithSubOpts(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "FEEDSERVICE", Subjects: []string{"feedservice.>"}}); err != nil {
+		t.Skip("jetstream:", err)
+	}
+	defer js.DeleteStream("FEEDSERVICE")
+
+	_, err = js.Publish("feedservice.post", []byte(`{"from":"old"}`))
+	assert.NoError(t, err)
+	received := make(chan string, 2)
+	s := subly.NewJetStreamSubscriber(ctx, js, subly.WithSubOpts(nats.DeliverNew()))
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"feedservice.post": func(tr *TimeRequest) { received <- tr.From },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = js.Publish("feedservice.post", []byte(`{"from":"new"}`))
+	assert.NoError(t, err)
+	select {
+	case from := <-received:
+		assert.Equal(t, "new", from)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+	select {
+	case from := <-received:
+		t.Fatalf("received %q, published before subscribing", from)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chanLogger, 10)
+	core := subly.NewSubscriber(ctx, econn, subly.WithSubOpts(nats.DeliverNew()), subly.WithLogger(logs))
+	defer core.Close()
+	select {
+	case l := <-logs:
+		assert.Contains(t, l, "subscription options need JetStream")
+	default:
+		t.Fatal("sub opts of a core subscriber got ignored silently")
+	}
+	_, err = core.SubscribeFunc(map[string]interface{}{"feedservice.core": func(tr *TimeRequest) {}})
+	assert.NoError(t, err)
+}
+
+func TestJetStreamSubscriberRespond(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "QUOTESERVICE", Subjects: []string{"quoteservice.>"}}); err != nil {
+		t.Skip("jetstream:", err)
+	}
+	defer js.DeleteStream("QUOTESERVICE")
+
+	responded := make(chan error, 1)
+	replies := make(chan []string, 1)
+	s := subly.NewJetStreamSubscriber(ctx, js)
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"quoteservice.ask": func(ctx context.Context, tr *TimeRequest) {
+			reply, ok := subly.ReplySubject(ctx)
+			c, _ := subly.FromContext(ctx)
+			replies <- []string{reply, fmt.Sprint(ok), c.Reply()}
+			responded <- subly.Respond(ctx, &TimeResponse{From: tr.From})
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = js.Publish("quoteservice.ask", []byte(`{"from":"dc0d"}`))
+	assert.NoError(t, err)
+	select {
+	case err := <-responded:
+		assert.ErrorIs(t, err, subly.ErrNoReply)
+		assert.Equal(t, []string{"", "false", ""}, <-replies)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+}
+
+type echoService struct{}
+
+func (echoService) EchoMessage(tr *TimeRequest) (*TimeResponse, error) {
+	if tr.From == "" {
+		return nil, errors.New("anonymous")
+	}
+	return &TimeResponse{From: tr.From}, nil
+}
+
+func TestSubscriberGobEncoder(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, nats.GOB_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithSubjectPrefix("gob"))
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(echoService{})) {
+		return
+	}
+
+	var res TimeResponse
+	assert.NoError(t, econn.Request("gob.echoservice.echo", &TimeRequest{From: "dc0d"}, &res, time.Second*3))
+	assert.Equal(t, "dc0d", res.From)
+
+	var reply subly.ErrorReply
+	assert.NoError(t, econn.Request("gob.echoservice.echo", &TimeRequest{}, &reply, time.Second*3))
+	assert.Equal(t, "anonymous", reply.Error)
+}
+
+type greetService struct{}
+
+func (greetService) GreetMessage(name *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	if name.GetValue() == "" {
+		return nil, errors.New("anonymous")
+	}
+	return wrapperspb.String("hello " + name.GetValue()), nil
+}
+
+func TestSubscriberProtobufEncoder(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, protobuf.PROTOBUF_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithSubjectPrefix("protobuf"))
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(greetService{})) {
+		return
+	}
+
+	res := &wrapperspb.StringValue{}
+	assert.NoError(t, econn.Request("protobuf.greetservice.greet", wrapperspb.String("dc0d"), res, time.Second*3))
+	assert.Equal(t, "hello dc0d", res.GetValue())
+
+	data, err := proto.Marshal(&wrapperspb.StringValue{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	m, err := conn.Request("protobuf.greetservice.greet", data, time.Second*3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "anonymous", m.Header.Get(subly.ErrorHeader))
+	}
+}
+
+func TestRawSubscriber(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msgs := make(chan *nats.Msg, 1)
+	s := subly.NewRawSubscriber(ctx, conn)
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"rawservice.echo": func(subject string, data []byte) []byte { return append([]byte(subject+" "), data...) },
+		"rawservice.msg":  func(m *nats.Msg) { msgs <- m },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m, err := conn.Request("rawservice.echo", []byte{0xde, 0xad}, time.Second*3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, append([]byte("rawservice.echo "), 0xde, 0xad), m.Data)
+	}
+
+	assert.NoError(t, conn.Publish("rawservice.msg", []byte("raw")))
+	select {
+	case m := <-msgs:
+		assert.Equal(t, "raw", string(m.Data))
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+}
+
+func TestSubscriberSubscribeN(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	received := make(chan string, 3)
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	sub, err := s.SubscribeN("timeservice.once", 2, func(tr *TimeRequest) { received <- tr.From })
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, from := range []string{"a", "b", "c"} {
+		assert.NoError(t, econn.Publish("timeservice.once", &TimeRequest{From: from}))
+	}
+	assert.NoError(t, econn.Flush())
+	for _, want := range []string{"a", "b"} {
+		select {
+		case got := <-received:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second * 3):
+			t.Fatal("no message")
+		}
+	}
+	select {
+	case got := <-received:
+		t.Fatal("received after the limit:", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.False(t, sub.IsValid())
+
+	s2 := subly.NewSubscriber(ctx, econn, subly.WithAutoUnsubscribe(1))
+	defer s2.Close()
+	_, err = s2.SubscribeFunc(map[string]interface{}{
+		"timeservice.limited": func(tr *TimeRequest) { received <- tr.From },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, from := range []string{"a", "b"} {
+		assert.NoError(t, econn.Publish("timeservice.limited", &TimeRequest{From: from}))
+	}
+	assert.NoError(t, econn.Flush())
+	select {
+	case got := <-received:
+		assert.Equal(t, "a", got)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+	select {
+	case got := <-received:
+		t.Fatal("received after the limit:", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSubscriberWithPendingLimits(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithPendingLimits(100000, -1))
+	defer s.Close()
+	assert.NoError(t, s.Subscribe(&timeService{econn}))
+	for _, sub := range s.Subscriptions() {
+		msgs, bytes, err := sub.PendingLimits()
+		assert.NoError(t, err)
+		assert.Equal(t, 100000, msgs)
+		assert.Equal(t, -1, bytes)
+	}
+
+	s = subly.NewSubscriber(ctx, econn, subly.WithPendingLimits(10, 0))
+	defer s.Close()
+	sub, err := s.SubscribeN("timeservice.limits", 5, func(tr *TimeRequest) {})
+	if assert.NoError(t, err) {
+		msgs, bytes, err := sub.PendingLimits()
+		assert.NoError(t, err)
+		assert.Equal(t, 10, msgs)
+		assert.Equal(t, nats.DefaultSubPendingBytesLimit, bytes)
+	}
+}
+
+func TestSubscriberWithPendingLimitsEveryPath(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithPendingLimits(10, -1), subly.WithAutoUnsubscribe(1))
+	defer s.Close()
+	assert.NoError(t, subly.SubscribeTyped(s, "paths.typed", func(tr *TimeRequest) {}))
+	assert.NoError(t, subly.QueueSubscribeTyped(s, "paths.queued", "workers", func(tr *TimeRequest) {}))
+	assert.NoError(t, s.SubscribeFallback("paths.>", func(string, *nats.Msg) {}))
+	ch := make(chan *nats.Msg, 4)
+	_, err = s.SubscribeChan("paths.chan", ch)
+	assert.NoError(t, err)
+
+	for _, subject := range []string{"paths.typed", "paths.queued", "paths.>"} {
+		sub, ok := s.SubscriptionFor(subject)
+		if !assert.True(t, ok, subject) {
+			continue
+		}
+		msgs, bytes, err := sub.PendingLimits()
+		assert.NoError(t, err)
+		assert.Equal(t, 10, msgs, subject)
+		assert.Equal(t, -1, bytes, subject)
+	}
+
+	for _, from := range []string{"a", "b"} {
+		assert.NoError(t, econn.Publish("paths.chan", &TimeRequest{From: from}))
+	}
+	assert.NoError(t, econn.Flush())
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+	select {
+	case m := <-ch:
+		t.Fatal("received after the limit:", string(m.Data))
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSubscriberNoDuplicatesEveryPath(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithNoDuplicates())
+	defer s.Close()
+	ch := make(chan *nats.Msg, 4)
+	paths := map[string]func(subject string) error{
+		"SubscribeN": func(subject string) error {
+			_, err := s.SubscribeN(subject, 5, func(tr *TimeRequest) {})
+			return err
+		},
+		"SubscribeTyped": func(subject string) error {
+			return subly.SubscribeTyped(s, subject, func(tr *TimeRequest) {})
+		},
+		"QueueSubscribeTyped": func(subject string) error {
+			return subly.QueueSubscribeTyped(s, subject, "workers", func(tr *TimeRequest) {})
+		},
+		"SubscribeChan": func(subject string) error {
+			_, err := s.SubscribeChan(subject, ch)
+			return err
+		},
+		"QueueSubscribeChan": func(subject string) error {
+			_, err := s.QueueSubscribeChan(subject, "workers", ch)
+			return err
+		},
+		"SubscribeFallback": func(subject string) error {
+			return s.SubscribeFallback(subject, func(string, *nats.Msg) {})
+		},
+	}
+	for name, subscribe := range paths {
+		subject := "dups." + strings.ToLower(name)
+		assert.NoError(t, subscribe(subject), name)
+		assert.ErrorIs(t, subscribe(subject), subly.ErrDuplicateSubject, name)
+		_, err := s.SubscribeFunc(map[string]interface{}{subject: func(tr *TimeRequest) {}})
+		assert.ErrorIs(t, err, subly.ErrDuplicateSubject, name)
+	}
+
+	received := make(chan struct{}, 1)
+	_, err = s.SubscribeN("dups.once", 1, func(tr *TimeRequest) { received <- struct{}{} })
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, econn.Publish("dups.once", &TimeRequest{}))
+	select {
+	case <-received:
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message")
+	}
+	assert.Eventually(t, func() bool {
+		_, err := s.SubscribeN("dups.once", 1, func(tr *TimeRequest) {})
+		return err == nil
+	}, time.Second*3, time.Millisecond*10, "subject of a finished subscription stays claimed")
+}
+
+func TestSubscriberWithErrorHandler(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	errs := make(chan string, 10)
+	s := subly.NewSubscriber(ctx, econn,
+		subly.WithPendingLimits(1, -1),
+		subly.WithErrorHandler(func(subject string, err error) {
+			if errors.Is(err, nats.ErrSlowConsumer) {
+				errs <- subject
+			}
+		}))
+	defer s.Close()
+	release := make(chan struct{})
+	defer close(release)
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.slow": func(tr *TimeRequest) { <-release },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, econn.Publish("timeservice.slow", &TimeRequest{}))
+	}
+	select {
+	case subject := <-errs:
+		assert.Equal(t, "timeservice.slow", subject)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no slow consumer error")
+	}
+}
+
+func TestSubscriberDrainWithTimeout(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	handled := make(chan string, 3)
+	s := subly.NewSubscriber(ctx, econn)
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.drain": func(tr *TimeRequest) {
+			time.Sleep(time.Millisecond * 20)
+			handled <- tr.From
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, from := range []string{"a", "b", "c"} {
+		assert.NoError(t, econn.Publish("timeservice.drain", &TimeRequest{From: from}))
+	}
+	assert.NoError(t, econn.Flush())
+	assert.NoError(t, s.DrainWithTimeout(time.Second*3))
+	assert.Len(t, handled, 3)
+	assert.Empty(t, s.Subscriptions())
+
+	release := make(chan struct{})
+	defer close(release)
+	s = subly.NewSubscriber(ctx, econn)
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.stuck": func(tr *TimeRequest) { <-release },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, econn.Publish("timeservice.stuck", &TimeRequest{}))
+	assert.NoError(t, econn.Flush())
+	err = s.DrainWithTimeout(time.Millisecond * 100)
+	assert.ErrorIs(t, err, subly.ErrDrainTimeout)
+	assert.Contains(t, err.Error(), "1 of 1 subscriptions")
+}
+
+func TestSubscriberWithCorrelationHeader(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn, subly.WithCorrelationHeader(""), subly.WithSubjectPrefix("correlated"))
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(echoService{})) {
+		return
+	}
+
+	for _, data := range []string{`{"from":"dc0d"}`, `{}`} {
+		req := nats.NewMsg("correlated.echoservice.echo")
+		req.Data = []byte(data)
+		req.Header.Set(subly.DefaultCorrelationHeader, "42")
+		res, err := conn.RequestMsg(req, time.Second*3)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "42", res.Header.Get(subly.DefaultCorrelationHeader))
+		}
+	}
+
+	res, err := conn.Request("correlated.echoservice.echo", []byte(`{"from":"dc0d"}`), time.Second*3)
+	if assert.NoError(t, err) {
+		assert.Empty(t, res.Header.Get(subly.DefaultCorrelationHeader))
+		assert.JSONEq(t, `{"from":"dc0d","time":"0001-01-01T00:00:00Z"}`, string(res.Data))
+	}
+}
+
+func TestSubscriberPauseResume(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	received := make(chan string, 3)
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	_, err = s.SubscribeFunc(map[string]interface{}{
+		"timeservice.pausable": func(tr *TimeRequest) { received <- tr.From },
+	}, "pausers")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, s.Pause("timeservice.pausable"))
+	assert.NoError(t, econn.Publish("timeservice.pausable", &TimeRequest{From: "paused"}))
+	assert.NoError(t, econn.Flush())
+	assert.NoError(t, s.Resume("timeservice.pausable"))
+	assert.NoError(t, econn.Flush())
+	assert.NoError(t, econn.Publish("timeservice.pausable", &TimeRequest{From: "resumed"}))
+	select {
+	case from := <-received:
+		assert.Equal(t, "resumed", from)
+	case <-time.After(time.Second * 3):
+		t.Fatal("no message after resume")
+	}
+	assert.Equal(t, "pausers", s.Subscriptions()[0].Queue)
+	assert.ErrorIs(t, s.Pause("timeservice.unknown"), subly.ErrNotSubscribed)
+}
+
+func TestSubscriberUnsubscribe(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	s := subly.NewSubscriber(ctx, econn)
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(&timeService{econn})) {
+		return
+	}
+	subs := s.Subscriptions()
+	assert.NoError(t, s.Unsubscribe(&timeService{econn}))
+	assert.Empty(t, s.Subscriptions())
+	for _, sub := range subs {
+		assert.False(t, sub.IsValid(), sub.Subject)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	opts := []subly.Option{subly.WithSubjectPrefix("published"), subly.WithNamingStyle(subly.NamingKebab)}
+	s := subly.NewSubscriber(ctx, econn, opts...)
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(echoService{})) {
+		return
+	}
+	p := subly.NewPublisher(econn, opts...)
+
+	subject, err := p.Subject("timeservice", "WaitMessageQueue")
+	assert.NoError(t, err)
+	assert.Equal(t, "published.timeservice.wait", subject)
+	subject, err = p.Subject("timeservice", "SubAction")
+	assert.NoError(t, err)
+	assert.Equal(t, "published.timeservice.sub-action", subject)
+
+	var res TimeResponse
+	assert.NoError(t, p.Request(ctx, echoService{}, "EchoMessage", &TimeRequest{From: "dc0d"}, &res))
+	assert.Equal(t, "dc0d", res.From)
+	assert.NoError(t, p.Publish(echoService{}, "EchoMessage", &TimeRequest{From: "dc0d"}))
+	assert.ErrorIs(t, p.Publish(echoService{}, "Echo", nil), subly.ErrUnknownMethod)
+}
+
+func TestPublisherWithPrefixFunc(t *testing.T) {
+	conn, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	econn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer econn.Close()
+
+	domain := func(t reflect.Type) string {
+		if t == reflect.TypeOf(echoService{}) {
+			return "echoes"
+		}
+		return ""
+	}
+	opts := []subly.Option{subly.WithSubjectPrefix("static"), subly.WithPrefixFunc(domain)}
+	s := subly.NewSubscriber(ctx, econn, opts...)
+	defer s.Close()
+	if !assert.NoError(t, s.Subscribe(echoService{})) {
+		return
+	}
+	p := subly.NewPublisher(econn, opts...)
+
+	subject, err := p.Subject(echoService{}, "EchoMessage")
+	assert.NoError(t, err)
+	assert.Equal(t, "echoes.echoservice.echo", subject)
+	_, ok := s.SubscriptionFor(subject)
+	assert.True(t, ok)
+	var res TimeResponse
+	assert.NoError(t, p.Request(ctx, echoService{}, "EchoMessage", &TimeRequest{From: "dc0d"}, &res))
+	assert.Equal(t, "dc0d", res.From)
+
+	_, err = p.Subject("echoservice", "EchoMessage")
+	assert.ErrorIs(t, err, subly.ErrServiceByName)
+}
@@ -0,0 +1,71 @@
+package subly
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SubscribeTyped subscribes a strongly typed handler to subject. Messages get
+// decoded using the encoder of the connection, without reflection based dispatch.
+// Like SubscribeFunc, the subject prefix applies and the subscription gets
+// unsubscribed when context got canceled.
+func SubscribeTyped[T any](s *Subscriber, subject string, handler func(*T)) error {
+	subject = s.opts.prefixed(subject)
+	if err := s.validate(subject, subject); err != nil {
+		return s.noteBind(subject, err)
+	}
+	if err := s.claim(subject, subject); err != nil {
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	cb := typed(s, subject, handler)
+	_, err := s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return s.conn.Subscribe(subject, cb)
+	}))
+	if err != nil {
+		s.release(subject)
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	return s.flushAfter(s.noteBind(subject, nil))
+}
+
+// QueueSubscribeTyped is the queue variant of SubscribeTyped.
+func QueueSubscribeTyped[T any](s *Subscriber, subject, queue string, handler func(*T)) error {
+	subject = s.opts.prefixed(subject)
+	if err := s.validate(subject, subject); err != nil {
+		return s.noteBind(subject, err)
+	}
+	if err := s.claim(subject, subject); err != nil {
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	cb := typed(s, subject, handler)
+	_, err := s.subscribe(s.setup(s.opts.autoUnsubscribe, func() (*nats.Subscription, error) {
+		return s.conn.QueueSubscribe(subject, queue, cb)
+	}))
+	if err != nil {
+		s.release(subject)
+		return s.noteBind(subject, subscribeError(subject, err))
+	}
+	return s.flushAfter(s.noteBind(subject, nil))
+}
+
+func typed[T any](s *Subscriber, subject string, handler func(*T)) func(*nats.Msg) {
+	return s.dispatch(subject, func(ctx context.Context, m *nats.Msg) error {
+		v := new(T)
+		if err := s.unmarshal(m.Subject, m.Data, v); err != nil {
+			s.decodeFailed(m, err)
+			return err
+		}
+		if err := s.validatePayload(m.Subject, v); err != nil {
+			return err
+		}
+		s.audit(m.Subject, v)
+		return s.retry(ctx, m.Subject, func() error {
+			handler(v)
+			return nil
+		})
+	}, true, func(m *nats.Msg) (interface{}, error) {
+		v := new(T)
+		return v, s.unmarshal(m.Subject, m.Data, v)
+	})
+}